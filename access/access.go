@@ -0,0 +1,192 @@
+package access
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// The lists of a Control
+const (
+	Allow = "allow"
+	Deny  = "deny"
+)
+
+// Control decides which clients may use the proxy by allow and deny lists of CIDRs.
+// A client is rejected if it is in the deny list
+// or if the allow list isn't empty and the client isn't in it.
+type Control struct {
+	sync.RWMutex
+	allow      []*net.IPNet
+	deny       []*net.IPNet
+	denied     uint64
+	notAllowed uint64
+}
+
+// ParseCIDR parses a CIDR like "10.0.0.0/8" or a single IP which is treated as /32 or /128
+func ParseCIDR(entry string) (*net.IPNet, error) {
+	entry = strings.TrimSpace(entry)
+	if !strings.Contains(entry, "/") {
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, errors.New("invalid IP or CIDR \"" + entry + "\"")
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(entry)
+	if err != nil {
+		return nil, errors.New("invalid IP or CIDR \"" + entry + "\"")
+	}
+	return ipNet, nil
+}
+
+// Update replaces both lists
+func (c *Control) Update(allow, deny []string) error {
+	allowNets, err := parseList(allow)
+	if err != nil {
+		return err
+	}
+	denyNets, err := parseList(deny)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.allow = allowNets
+	c.deny = denyNets
+	return nil
+}
+
+// Add adds the entry to the list (Allow or Deny)
+func (c *Control) Add(list, entry string) error {
+	ipNet, err := ParseCIDR(entry)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	nets, err := c.list(list)
+	if err != nil {
+		return err
+	}
+	for _, n := range *nets {
+		if n.String() == ipNet.String() {
+			return nil
+		}
+	}
+	*nets = append(*nets, ipNet)
+	return nil
+}
+
+// Remove removes the entry from the list (Allow or Deny)
+func (c *Control) Remove(list, entry string) error {
+	ipNet, err := ParseCIDR(entry)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	nets, err := c.list(list)
+	if err != nil {
+		return err
+	}
+	remaining := make([]*net.IPNet, 0, len(*nets))
+	for _, n := range *nets {
+		if n.String() != ipNet.String() {
+			remaining = append(remaining, n)
+		}
+	}
+	if len(remaining) == len(*nets) {
+		return errors.New(ipNet.String() + " isn't in the " + list + " list")
+	}
+	*nets = remaining
+	return nil
+}
+
+// Lists returns the entries of both lists
+func (c *Control) Lists() (allow, deny []string) {
+	c.RLock()
+	defer c.RUnlock()
+	return formatList(c.allow), formatList(c.deny)
+}
+
+// Allowed returns if the client may use the proxy and counts rejected clients
+func (c *Control) Allowed(addr net.Addr) bool {
+	ip := IP(addr)
+	c.RLock()
+	defer c.RUnlock()
+	if contains(c.deny, ip) {
+		atomic.AddUint64(&c.denied, 1)
+		return false
+	}
+	if len(c.allow) > 0 && !contains(c.allow, ip) {
+		atomic.AddUint64(&c.notAllowed, 1)
+		return false
+	}
+	return true
+}
+
+// Rejected returns the amount of clients rejected because they are in the deny list
+// and because they aren't in the allow list
+func (c *Control) Rejected() (denied, notAllowed uint64) {
+	return atomic.LoadUint64(&c.denied), atomic.LoadUint64(&c.notAllowed)
+}
+
+// IP returns the IP of a TCP or UDP address
+func IP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func (c *Control) list(list string) (*[]*net.IPNet, error) {
+	switch list {
+	case Allow:
+		return &c.allow, nil
+	case Deny:
+		return &c.deny, nil
+	}
+	return nil, errors.New("unknown list \"" + list + "\"")
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseList(entries []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		ipNet, err := ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func formatList(nets []*net.IPNet) []string {
+	entries := make([]string, len(nets))
+	for i, n := range nets {
+		entries[i] = n.String()
+	}
+	return entries
+}
@@ -0,0 +1,53 @@
+package access
+
+import (
+	"net"
+	"testing"
+)
+
+func udpAddr(ip string) net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP(ip), Port: 40000}
+}
+
+func TestControl(t *testing.T) {
+	c := &Control{}
+	if err := c.Update([]string{"10.0.0.0/8", "2001:db8::/32"}, []string{"10.1.0.0/16", "10.2.3.4"}); err != nil {
+		t.Fatal(err)
+	}
+	for ip, allowed := range map[string]bool{
+		"10.0.0.1":    true,
+		"10.1.2.3":    false,
+		"10.2.3.4":    false,
+		"10.2.3.5":    true,
+		"192.168.0.1": false,
+		"2001:db8::1": true,
+		"2001:db9::1": false,
+	} {
+		if c.Allowed(udpAddr(ip)) != allowed {
+			t.Errorf("%s allowed should be %t", ip, allowed)
+		}
+	}
+	if denied, notAllowed := c.Rejected(); denied != 2 || notAllowed != 2 {
+		t.Errorf("rejected %d denied and %d not allowed clients", denied, notAllowed)
+	}
+
+	if err := c.Remove(Deny, "10.2.3.4"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Add(Allow, "192.168.0.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Allowed(udpAddr("10.2.3.4")) || !c.Allowed(udpAddr("192.168.0.1")) {
+		t.Error("changed lists not applied")
+	}
+	if err := c.Add(Deny, "10.0.0.0/33"); err == nil {
+		t.Error("added an invalid CIDR")
+	}
+	if err := c.Remove(Deny, "10.2.3.4"); err == nil {
+		t.Error("removed an entry which isn't in the list")
+	}
+	allow, deny := c.Lists()
+	if len(allow) != 3 || len(deny) != 1 || deny[0] != "10.1.0.0/16" {
+		t.Errorf("unexpected lists %v %v", allow, deny)
+	}
+}
@@ -0,0 +1,420 @@
+package access
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BanPolicy defines when and for how long clients are banned.
+// A threshold of 0 disables it.
+type BanPolicy struct {
+	ConnectionsPerSecond      float64
+	PacketsPerSecond          float64
+	FailedHandshakesPerMinute int
+	BanSeconds                float64
+	MaxBanSeconds             float64
+	File                      string
+}
+
+// Ban is a banned client
+type Ban struct {
+	IP       string    `json:"ip"`
+	Until    time.Time `json:"until"`
+	Offenses int       `json:"offenses"`
+	Reason   string    `json:"reason"`
+}
+
+// Permanent returns if the ban doesn't expire
+func (b Ban) Permanent() bool {
+	return b.Until.IsZero()
+}
+
+// banShards is the amount of independently locked parts of the bans and counters
+const banShards = 32
+
+// MaxFloodCounters is the maximum amount of clients counted at once.
+// Once reached a random counter is dropped for every new client.
+const MaxFloodCounters = 65536
+
+// Bans bans clients which flood the proxy for an escalating duration.
+// The bans and counters are sharded by the IP of the client.
+type Bans struct {
+	rejected uint64
+	entries  int64
+	policy   atomic.Value
+	shards   [banShards]banShard
+	saveLock sync.Mutex
+}
+
+// banShard holds the bans and counters of a part of the clients
+type banShard struct {
+	sync.RWMutex
+	bans      map[ipKey]*Ban
+	counters  map[ipKey]*floodCounter
+	lastSweep time.Time
+}
+
+// ipKey is an IP in its 16 byte form
+type ipKey [16]byte
+
+// floodCounter counts the actions of a client in the current window
+type floodCounter struct {
+	second      time.Time
+	connections int
+	packets     int
+	minute      time.Time
+	failed      int
+}
+
+// NewBans creates new Bans with the policy and loads the bans of its file
+func NewBans(policy BanPolicy) *Bans {
+	b := &Bans{}
+	b.policy.Store(policy)
+	now := time.Now()
+	for i := range b.shards {
+		b.shards[i].bans = make(map[ipKey]*Ban)
+		b.shards[i].counters = make(map[ipKey]*floodCounter)
+		b.shards[i].lastSweep = now
+	}
+	if policy.File != "" {
+		if err := b.load(policy.File); err != nil && !os.IsNotExist(err) {
+			log.Printf("Couldn't load the bans from %s: %v", policy.File, err)
+		}
+	}
+	return b
+}
+
+// Update replaces the policy. Existing bans stay.
+func (b *Bans) Update(policy BanPolicy) {
+	b.policy.Store(policy)
+}
+
+// Policy returns the current policy
+func (b *Bans) Policy() BanPolicy {
+	return b.policy.Load().(BanPolicy)
+}
+
+// Banned returns if the client is banned and counts the rejection
+func (b *Bans) Banned(addr net.Addr) bool {
+	if atomic.LoadInt64(&b.entries) == 0 {
+		return false
+	}
+	ip := IP(addr)
+	if ip == nil {
+		return false
+	}
+	key := keyOf(ip)
+	s := b.shard(key)
+	s.RLock()
+	ban, ok := s.bans[key]
+	banned := ok && ban.active(time.Now())
+	s.RUnlock()
+	if banned {
+		atomic.AddUint64(&b.rejected, 1)
+	}
+	return banned
+}
+
+// Connection counts a connection attempt of the client and returns if the client got banned by it
+func (b *Bans) Connection(addr net.Addr) bool {
+	policy := b.Policy()
+	if policy.ConnectionsPerSecond <= 0 {
+		return false
+	}
+	return b.count(addr, policy, func(c *floodCounter) (bool, string) {
+		c.connections++
+		return float64(c.connections) > policy.ConnectionsPerSecond, "too many connections"
+	})
+}
+
+// Packet counts a datagram of the client and returns if the client got banned by it
+func (b *Bans) Packet(addr net.Addr) bool {
+	policy := b.Policy()
+	if policy.PacketsPerSecond <= 0 {
+		return false
+	}
+	return b.count(addr, policy, func(c *floodCounter) (bool, string) {
+		c.packets++
+		return float64(c.packets) > policy.PacketsPerSecond, "too many packets"
+	})
+}
+
+// FailedHandshake counts a connection of the client which was closed
+// before the client sent anything and returns if the client got banned by it
+func (b *Bans) FailedHandshake(addr net.Addr) bool {
+	policy := b.Policy()
+	if policy.FailedHandshakesPerMinute <= 0 {
+		return false
+	}
+	return b.count(addr, policy, func(c *floodCounter) (bool, string) {
+		c.failed++
+		return c.failed > policy.FailedHandshakesPerMinute, "too many failed handshakes"
+	})
+}
+
+// CountsFailedHandshakes returns if failed handshakes should be reported
+func (b *Bans) CountsFailedHandshakes() bool {
+	return b.Policy().FailedHandshakesPerMinute > 0
+}
+
+func (b *Bans) count(addr net.Addr, policy BanPolicy, exceeded func(*floodCounter) (bool, string)) bool {
+	ip := IP(addr)
+	if ip == nil {
+		return false
+	}
+	key := keyOf(ip)
+	now := time.Now()
+
+	s := b.shard(key)
+	s.Lock()
+	b.sweep(s, now, policy)
+	c, ok := s.counters[key]
+	if !ok {
+		if len(s.counters) >= MaxFloodCounters/banShards {
+			for other := range s.counters {
+				delete(s.counters, other)
+				break
+			}
+		}
+		c = &floodCounter{second: now, minute: now}
+		s.counters[key] = c
+	}
+	if now.Sub(c.second) >= time.Second {
+		c.second, c.connections, c.packets = now, 0, 0
+	}
+	if now.Sub(c.minute) >= time.Minute {
+		c.minute, c.failed = now, 0
+	}
+	over, reason := exceeded(c)
+	if !over {
+		s.Unlock()
+		return false
+	}
+	delete(s.counters, key)
+	ban := b.escalate(s, key, ip, now, reason, policy)
+	s.Unlock()
+
+	log.Printf("%s Banned until %s: %s", ban.IP, ban.Until.Format(time.RFC3339), reason)
+	b.save()
+	return true
+}
+
+// escalate bans the client for the ban duration doubled by every previous offense
+func (b *Bans) escalate(s *banShard, key ipKey, ip net.IP, now time.Time, reason string, policy BanPolicy) Ban {
+	base := time.Duration(policy.BanSeconds * float64(time.Second))
+	max := time.Duration(policy.MaxBanSeconds * float64(time.Second))
+	ban, ok := s.bans[key]
+	if !ok || ban.forgotten(now, max) {
+		ban = b.add(s, key, ip)
+	}
+	ban.Offenses++
+	duration := base
+	for i := 1; i < ban.Offenses && duration < max; i++ {
+		duration *= 2
+	}
+	if duration > max {
+		duration = max
+	}
+	ban.Until = now.Add(duration)
+	ban.Reason = reason
+	return *ban
+}
+
+// add stores a new ban of the client in the shard
+func (b *Bans) add(s *banShard, key ipKey, ip net.IP) *Ban {
+	if _, ok := s.bans[key]; !ok {
+		atomic.AddInt64(&b.entries, 1)
+	}
+	ban := &Ban{IP: ip.String()}
+	s.bans[key] = ban
+	return ban
+}
+
+// remove deletes the ban of the client from the shard
+func (b *Bans) remove(s *banShard, key ipKey) {
+	if _, ok := s.bans[key]; ok {
+		delete(s.bans, key)
+		atomic.AddInt64(&b.entries, -1)
+	}
+}
+
+// Ban bans the IP for the duration, forever if the duration is 0
+func (b *Bans) Ban(entry string, duration time.Duration) error {
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return errors.New("invalid IP \"" + entry + "\"")
+	}
+	key := keyOf(ip)
+	s := b.shard(key)
+	s.Lock()
+	ban, ok := s.bans[key]
+	if !ok {
+		ban = b.add(s, key, ip)
+	}
+	ban.Offenses++
+	ban.Until = time.Time{}
+	if duration > 0 {
+		ban.Until = time.Now().Add(duration)
+	}
+	ban.Reason = "manual"
+	s.Unlock()
+	b.save()
+	return nil
+}
+
+// Unban removes the ban of the IP and returns if it was banned
+func (b *Bans) Unban(entry string) (bool, error) {
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return false, errors.New("invalid IP \"" + entry + "\"")
+	}
+	key := keyOf(ip)
+	s := b.shard(key)
+	s.Lock()
+	ban, ok := s.bans[key]
+	banned := ok && ban.active(time.Now())
+	b.remove(s, key)
+	s.Unlock()
+	b.save()
+	return banned, nil
+}
+
+// List returns the active bans sorted by IP
+func (b *Bans) List() []Ban {
+	now := time.Now()
+	bans := make([]Ban, 0)
+	for _, ban := range b.all() {
+		if ban.active(now) {
+			bans = append(bans, ban)
+		}
+	}
+	return bans
+}
+
+// Rejected returns the amount of rejected connections and datagrams of banned clients
+func (b *Bans) Rejected() uint64 {
+	return atomic.LoadUint64(&b.rejected)
+}
+
+// all returns every ban including expired ones sorted by IP
+func (b *Bans) all() []Ban {
+	bans := make([]Ban, 0, atomic.LoadInt64(&b.entries))
+	for i := range b.shards {
+		s := &b.shards[i]
+		s.RLock()
+		for _, ban := range s.bans {
+			bans = append(bans, *ban)
+		}
+		s.RUnlock()
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].IP < bans[j].IP })
+	return bans
+}
+
+func (b *Bans) shard(key ipKey) *banShard {
+	hash := uint32(2166136261)
+	for _, c := range key {
+		hash = (hash ^ uint32(c)) * 16777619
+	}
+	return &b.shards[hash%banShards]
+}
+
+func keyOf(ip net.IP) ipKey {
+	var key ipKey
+	copy(key[:], ip.To16())
+	return key
+}
+
+// sweep removes old counters and forgotten bans of the shard
+func (b *Bans) sweep(s *banShard, now time.Time, policy BanPolicy) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for key, c := range s.counters {
+		if now.Sub(c.second) >= time.Second && now.Sub(c.minute) >= time.Minute {
+			delete(s.counters, key)
+		}
+	}
+	max := time.Duration(policy.MaxBanSeconds * float64(time.Second))
+	for key, ban := range s.bans {
+		if ban.forgotten(now, max) {
+			b.remove(s, key)
+		}
+	}
+}
+
+func (ban *Ban) active(now time.Time) bool {
+	return ban.Permanent() || now.Before(ban.Until)
+}
+
+// forgotten returns if the ban expired long enough ago to not escalate the next ban
+func (ban *Ban) forgotten(now time.Time, max time.Duration) bool {
+	return !ban.Permanent() && now.Sub(ban.Until) > max
+}
+
+// save writes the bans to the file of the policy if it is set
+func (b *Bans) save() {
+	path := b.Policy().File
+	if path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(b.all(), "", "    ")
+	if err != nil {
+		log.Printf("Couldn't save the bans: %v", err)
+		return
+	}
+
+	b.saveLock.Lock()
+	defer b.saveLock.Unlock()
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err == nil {
+		_, err = tmp.Write(data)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), path)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}
+	if err != nil {
+		log.Printf("Couldn't save the bans to %s: %v", path, err)
+	}
+}
+
+// load reads the bans of the file
+func (b *Bans) load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	bans := make([]Ban, 0)
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return err
+	}
+	for i := range bans {
+		ip := net.ParseIP(bans[i].IP)
+		if ip == nil {
+			continue
+		}
+		key := keyOf(ip)
+		s := b.shard(key)
+		s.Lock()
+		ban := b.add(s, key, ip)
+		ban.Until, ban.Offenses, ban.Reason = bans[i].Until, bans[i].Offenses, bans[i].Reason
+		s.Unlock()
+	}
+	return nil
+}
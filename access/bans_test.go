@@ -0,0 +1,84 @@
+package access
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBansEscalate(t *testing.T) {
+	b := NewBans(BanPolicy{PacketsPerSecond: 2, BanSeconds: 10, MaxBanSeconds: 30})
+	client := udpAddr("10.0.0.1")
+	for _, expected := range []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second} {
+		banned := false
+		for i := 0; i < 3; i++ {
+			banned = b.Packet(client)
+		}
+		if !banned {
+			t.Fatal("flooding client wasn't banned")
+		}
+		bans := b.List()
+		if len(bans) != 1 || bans[0].IP != "10.0.0.1" {
+			t.Fatalf("unexpected bans %+v", bans)
+		}
+		if d := time.Until(bans[0].Until); d > expected || d < expected-time.Second {
+			t.Errorf("banned for %v, expected %v", d, expected)
+		}
+	}
+	if !b.Banned(client) || b.Banned(udpAddr("10.0.0.2")) || b.Rejected() != 1 {
+		t.Error("unexpected ban check")
+	}
+	if banned, err := b.Unban("10.0.0.1"); err != nil || !banned || b.Banned(client) {
+		t.Errorf("unban failed: %v", err)
+	}
+}
+
+func TestBansWithoutThreshold(t *testing.T) {
+	b := NewBans(BanPolicy{BanSeconds: 10, MaxBanSeconds: 30})
+	for i := 0; i < 100; i++ {
+		if b.Packet(udpAddr("10.0.0.1")) || b.Connection(udpAddr("10.0.0.1")) {
+			t.Fatal("banned without a threshold")
+		}
+	}
+	for i := range b.shards {
+		if len(b.shards[i].counters) > 0 {
+			t.Fatal("counted without a threshold")
+		}
+	}
+
+	b.Update(BanPolicy{PacketsPerSecond: 1000})
+	for i := 0; i < MaxFloodCounters*2; i++ {
+		b.Packet(&net.UDPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), Port: 40000})
+	}
+	counters := 0
+	for i := range b.shards {
+		counters += len(b.shards[i].counters)
+	}
+	if counters == 0 || counters > MaxFloodCounters {
+		t.Errorf("%d counters exceed the limit", counters)
+	}
+}
+
+func TestBansPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	b := NewBans(BanPolicy{File: path})
+	if err := b.Ban("10.0.0.1", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Ban("2001:db8::1", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Ban("10.0.0.300", 0); err == nil {
+		t.Error("banned an invalid IP")
+	}
+
+	loaded := NewBans(BanPolicy{File: path})
+	bans := loaded.List()
+	if len(bans) != 2 || bans[0].IP != "10.0.0.1" || !bans[0].Permanent() || bans[1].Permanent() {
+		t.Fatalf("unexpected loaded bans %+v", bans)
+	}
+	if !loaded.Banned(udpAddr("2001:db8::1")) {
+		t.Error("loaded ban not applied")
+	}
+}
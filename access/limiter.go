@@ -0,0 +1,189 @@
+package access
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons a connection is rejected by the Limiter
+var (
+	ErrMaxConnections      = errors.New("too many connections")
+	ErrMaxConnectionsPerIP = errors.New("too many connections from this client")
+	ErrRateLimited         = errors.New("too many new connections from this client")
+)
+
+// sweepInterval is the interval in which idle clients are removed from the Limiter
+const sweepInterval = time.Minute
+
+// Limiter limits the concurrent connections of every client and in total
+// and the rate of new connections of every client.
+// Clients are grouped by the prefix of their IP.
+type Limiter struct {
+	sync.Mutex
+	limits      Limits
+	clients     map[string]*client
+	connections int
+	lastSweep   time.Time
+
+	rejectedMax   uint64
+	rejectedPerIP uint64
+	rejectedRate  uint64
+}
+
+// Limits are the limits of a Limiter. A limit of 0 disables it.
+// The prefixes group clients by their network, 0 uses the whole address.
+type Limits struct {
+	MaxConnections       int
+	MaxConnectionsPerIP  int
+	ConnectionsPerSecond float64
+	ConnectionBurst      int
+	IPv4Prefix           int
+	IPv6Prefix           int
+}
+
+// client holds the connections and the token bucket of a client
+type client struct {
+	connections int
+	tokens      float64
+	last        time.Time
+}
+
+// LimitStats holds the amount of rejected connections by their reason
+type LimitStats struct {
+	Connections       int
+	RejectedMax       uint64
+	RejectedPerIP     uint64
+	RejectedRateLimit uint64
+}
+
+// NewLimiter creates a new Limiter with the limits
+func NewLimiter(limits Limits) *Limiter {
+	return &Limiter{
+		limits:    limits,
+		clients:   make(map[string]*client),
+		lastSweep: time.Now(),
+	}
+}
+
+// Update replaces the limits. Open connections stay.
+func (l *Limiter) Update(limits Limits) {
+	l.Lock()
+	defer l.Unlock()
+	l.limits = limits
+}
+
+// Acquire checks the limits for a new connection of the client and counts it.
+// The returned release func must be called once the connection is closed.
+func (l *Limiter) Acquire(addr net.Addr) (release func(), err error) {
+	key := l.key(IP(addr))
+	now := time.Now()
+
+	l.Lock()
+	defer l.Unlock()
+	l.sweep(now)
+
+	if l.limits.MaxConnections > 0 && l.connections >= l.limits.MaxConnections {
+		atomic.AddUint64(&l.rejectedMax, 1)
+		return nil, ErrMaxConnections
+	}
+	c, ok := l.clients[key]
+	if !ok {
+		c = &client{tokens: l.burst(), last: now}
+		l.clients[key] = c
+	}
+	if l.limits.MaxConnectionsPerIP > 0 && c.connections >= l.limits.MaxConnectionsPerIP {
+		atomic.AddUint64(&l.rejectedPerIP, 1)
+		return nil, ErrMaxConnectionsPerIP
+	}
+	if l.limits.ConnectionsPerSecond > 0 {
+		c.refill(now, l.limits.ConnectionsPerSecond, l.burst())
+		if c.tokens < 1 {
+			atomic.AddUint64(&l.rejectedRate, 1)
+			return nil, ErrRateLimited
+		}
+		c.tokens--
+	}
+
+	c.connections++
+	l.connections++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.Lock()
+			defer l.Unlock()
+			c.connections--
+			l.connections--
+		})
+	}, nil
+}
+
+// Stats returns the amount of open connections and rejected connections
+func (l *Limiter) Stats() LimitStats {
+	l.Lock()
+	connections := l.connections
+	l.Unlock()
+	return LimitStats{
+		Connections:       connections,
+		RejectedMax:       atomic.LoadUint64(&l.rejectedMax),
+		RejectedPerIP:     atomic.LoadUint64(&l.rejectedPerIP),
+		RejectedRateLimit: atomic.LoadUint64(&l.rejectedRate),
+	}
+}
+
+// key returns the prefix of the IP the client is grouped by
+func (l *Limiter) key(ip net.IP) string {
+	l.Lock()
+	ipv4Prefix, ipv6Prefix := l.limits.IPv4Prefix, l.limits.IPv6Prefix
+	l.Unlock()
+	if ip4 := ip.To4(); ip4 != nil {
+		if ipv4Prefix > 0 {
+			return ip4.Mask(net.CIDRMask(ipv4Prefix, 32)).String()
+		}
+		return ip4.String()
+	}
+	if ipv6Prefix > 0 {
+		return ip.Mask(net.CIDRMask(ipv6Prefix, 128)).String()
+	}
+	return ip.String()
+}
+
+func (l *Limiter) burst() float64 {
+	if l.limits.ConnectionBurst > 0 {
+		return float64(l.limits.ConnectionBurst)
+	}
+	if l.limits.ConnectionsPerSecond > 1 {
+		return l.limits.ConnectionsPerSecond
+	}
+	return 1
+}
+
+// sweep removes clients without connections whose token bucket is full again
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, c := range l.clients {
+		if c.connections > 0 {
+			continue
+		}
+		if l.limits.ConnectionsPerSecond > 0 {
+			c.refill(now, l.limits.ConnectionsPerSecond, l.burst())
+			if c.tokens < l.burst() {
+				continue
+			}
+		}
+		delete(l.clients, key)
+	}
+}
+
+func (c *client) refill(now time.Time, rate, burst float64) {
+	c.tokens += now.Sub(c.last).Seconds() * rate
+	if c.tokens > burst {
+		c.tokens = burst
+	}
+	c.last = now
+}
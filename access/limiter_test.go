@@ -0,0 +1,48 @@
+package access
+
+import "testing"
+
+func TestLimiterPerIPAndPrefix(t *testing.T) {
+	l := NewLimiter(Limits{MaxConnections: 3, MaxConnectionsPerIP: 2, IPv4Prefix: 24})
+	release, err := l.Acquire(udpAddr("10.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Acquire(udpAddr("10.0.0.2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Acquire(udpAddr("10.0.0.3")); err != ErrMaxConnectionsPerIP {
+		t.Fatalf("expected the /24 to be limited, got %v", err)
+	}
+	if _, err := l.Acquire(udpAddr("10.0.1.1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Acquire(udpAddr("10.0.2.1")); err != ErrMaxConnections {
+		t.Fatalf("expected the total limit, got %v", err)
+	}
+
+	release()
+	release()
+	if _, err := l.Acquire(udpAddr("10.0.0.3")); err != nil {
+		t.Fatalf("released connection still counted: %v", err)
+	}
+	stats := l.Stats()
+	if stats.Connections != 3 || stats.RejectedPerIP != 1 || stats.RejectedMax != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestLimiterRate(t *testing.T) {
+	l := NewLimiter(Limits{ConnectionsPerSecond: 0.001, ConnectionBurst: 2})
+	for i := 0; i < 2; i++ {
+		if _, err := l.Acquire(udpAddr("2001:db8::1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := l.Acquire(udpAddr("2001:db8::1")); err != ErrRateLimited {
+		t.Fatalf("expected the rate limit, got %v", err)
+	}
+	if _, err := l.Acquire(udpAddr("2001:db8::2")); err != nil {
+		t.Fatalf("other client limited: %v", err)
+	}
+}
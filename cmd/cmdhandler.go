@@ -14,8 +14,20 @@ type CommandHandler struct {
 const helpText = `====COMMANDS====
 add <NAME> <ADDR> Add a server
 rem <NAME> Remove a server
+drain <NAME> [TIMEOUT] Stop new connections to a server and remove it once they are closed
+enable <NAME> Put a server back into rotation
+disable <NAME> Take a server out of rotation without removing it
 list show all servers
-save saves the config (overwrites the old one)`
+sessions show the UDP sessions of the clients
+allow <add|rem> <CIDR> Add/remove clients which may use the proxy
+deny <add|rem> <CIDR> Add/remove clients which may not use the proxy
+access show the access lists and rejected clients
+bans show the banned clients
+ban <IP> [DURATION] Ban a client, forever without a duration
+unban <IP> Remove the ban of a client
+bandwidth [connection|host|total <BYTES/S>] Show or change the bandwidth limits
+save saves the config (keeps a backup of the old one)
+rollback restores the previous config and applies it`
 
 // NewCommandHandler creates a new CommandHandler
 func NewCommandHandler() *CommandHandler {
@@ -0,0 +1,91 @@
+package cmds
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/worldOneo/glass-proxy/access"
+	"github.com/worldOneo/glass-proxy/config"
+	"github.com/worldOneo/glass-proxy/proxy"
+)
+
+// AccessListCmd is a command to add or remove entries of an access list
+type AccessListCmd struct {
+	proxyService proxy.Service
+	list         string
+}
+
+// NewAllowCommand creates a new AccessListCmd for the allow list
+func NewAllowCommand(proxyService proxy.Service) *AccessListCmd {
+	return &AccessListCmd{
+		proxyService: proxyService,
+		list:         access.Allow,
+	}
+}
+
+// NewDenyCommand creates a new AccessListCmd for the deny list
+func NewDenyCommand(proxyService proxy.Service) *AccessListCmd {
+	return &AccessListCmd{
+		proxyService: proxyService,
+		list:         access.Deny,
+	}
+}
+
+// Handle adds or removes the IP or CIDR and updates the config
+func (a *AccessListCmd) Handle(args []string) {
+	if len(args) < 2 || (args[0] != "add" && args[0] != "rem") {
+		fmt.Printf("\"%s\" needs 2 args, add or rem and the IP or CIDR\n", a.list)
+		return
+	}
+
+	control := a.proxyService.AccessControl()
+	var err error
+	if args[0] == "add" {
+		err = control.Add(a.list, args[1])
+	} else {
+		err = control.Remove(a.list, args[1])
+	}
+	if err != nil {
+		fmt.Printf("Couldn't update the %s list: %v\n", a.list, err)
+		return
+	}
+
+	allow, deny := control.Lists()
+	a.proxyService.UpdateConfig(func(cnf *config.Config) error {
+		cnf.Allow = allow
+		cnf.Deny = deny
+		return nil
+	})
+}
+
+// AccessCmd is a command to show the access lists and the rejected or limited clients
+type AccessCmd struct {
+	proxyService proxy.Service
+}
+
+// NewAccessCommand creates a new AccessCmd
+func NewAccessCommand(proxyService proxy.Service) *AccessCmd {
+	return &AccessCmd{
+		proxyService: proxyService,
+	}
+}
+
+// Handle prints the access lists and the amount of rejected clients
+func (a *AccessCmd) Handle(args []string) {
+	control := a.proxyService.AccessControl()
+	allow, deny := control.Lists()
+	denied, notAllowed := control.Rejected()
+	fmt.Printf("Allow: %s\n", formatEntries(allow, "everyone"))
+	fmt.Printf("Deny: %s\n", formatEntries(deny, "no one"))
+	fmt.Printf("Rejected: %d denied, %d not allowed\n", denied, notAllowed)
+	stats := a.proxyService.ConnectionLimiter().Stats()
+	fmt.Printf("Limited: %d total limit, %d per client limit, %d rate limit (%d connections open)\n",
+		stats.RejectedMax, stats.RejectedPerIP, stats.RejectedRateLimit, stats.Connections)
+}
+
+func formatEntries(entries []string, empty string) string {
+	if len(entries) == 0 {
+		return empty
+	}
+	return strings.Join(entries, ", ")
+}
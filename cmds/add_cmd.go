@@ -26,10 +26,13 @@ func (a *AddCmd) Handle(args []string) {
 		return
 	}
 
-	name := args[0]
-	addr := args[1]
-	a.proxyService.AddHost(config.HostConfig{
-		Name: name,
-		Addr: addr,
-	})
+	host := config.HostConfig{
+		Name: args[0],
+		Addr: args[1],
+	}
+	if problems := host.Validate(a.proxyService.GetConfig().Protocol); len(problems) > 0 {
+		fmt.Printf("Invalid server:\n%v\n", problems)
+		return
+	}
+	a.proxyService.AddHost(host)
 }
@@ -0,0 +1,95 @@
+package cmds
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/worldOneo/glass-proxy/proxy"
+)
+
+// BanCmd is a command to ban a client
+type BanCmd struct {
+	proxyService proxy.Service
+}
+
+// NewBanCommand creates a new BanCmd
+func NewBanCommand(proxyService proxy.Service) *BanCmd {
+	return &BanCmd{
+		proxyService: proxyService,
+	}
+}
+
+// Handle bans the IP for the optional duration (e.g. "10m" or "600" for seconds), forever without one
+func (b *BanCmd) Handle(args []string) {
+	if len(args) < 1 {
+		fmt.Println("\"ban\" needs at least 1 arg, the IP and optionally a duration")
+		return
+	}
+
+	var duration time.Duration
+	if len(args) > 1 {
+		var err error
+		duration, err = parseDuration(args[1])
+		if err != nil || duration <= 0 {
+			fmt.Printf("Invalid duration \"%s\"\n", args[1])
+			return
+		}
+	}
+	if err := b.proxyService.BanList().Ban(args[0], duration); err != nil {
+		fmt.Printf("Couldn't ban %s: %v\n", args[0], err)
+	}
+}
+
+// UnbanCmd is a command to remove the ban of a client
+type UnbanCmd struct {
+	proxyService proxy.Service
+}
+
+// NewUnbanCommand creates a new UnbanCmd
+func NewUnbanCommand(proxyService proxy.Service) *UnbanCmd {
+	return &UnbanCmd{
+		proxyService: proxyService,
+	}
+}
+
+// Handle removes the ban of the IP
+func (u *UnbanCmd) Handle(args []string) {
+	if len(args) < 1 {
+		fmt.Println("\"unban\" needs 1 arg, the IP")
+		return
+	}
+	banned, err := u.proxyService.BanList().Unban(args[0])
+	if err != nil {
+		fmt.Printf("Couldn't unban %s: %v\n", args[0], err)
+		return
+	}
+	if !banned {
+		fmt.Printf("%s isn't banned\n", args[0])
+	}
+}
+
+// BansCmd is a command to list the banned clients
+type BansCmd struct {
+	proxyService proxy.Service
+}
+
+// NewBansCommand creates a new BansCmd
+func NewBansCommand(proxyService proxy.Service) *BansCmd {
+	return &BansCmd{
+		proxyService: proxyService,
+	}
+}
+
+// Handle prints the banned clients and until when they are banned
+func (b *BansCmd) Handle(args []string) {
+	bans := b.proxyService.BanList()
+	list := bans.List()
+	fmt.Printf("%d banned, %d rejected\n", len(list), bans.Rejected())
+	for _, ban := range list {
+		until := "forever"
+		if !ban.Permanent() {
+			until = ban.Until.Format(time.RFC3339) + " (" + time.Until(ban.Until).Round(time.Second).String() + ")"
+		}
+		fmt.Printf("%-40s %-45s %d offenses, %s\n", ban.IP, until, ban.Offenses, ban.Reason)
+	}
+}
@@ -0,0 +1,94 @@
+package cmds
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/worldOneo/glass-proxy/proxy"
+)
+
+// BandwidthCmd is a command to show or change the bandwidth limits
+type BandwidthCmd struct {
+	proxyService proxy.Service
+}
+
+// NewBandwidthCommand creates a new BandwidthCmd
+func NewBandwidthCommand(proxyService proxy.Service) *BandwidthCmd {
+	return &BandwidthCmd{
+		proxyService: proxyService,
+	}
+}
+
+// Handle prints the bandwidth limits or changes one of them (connection, host or total)
+// to a rate in bytes per second like "512K" or "10M", 0 for unlimited
+func (b *BandwidthCmd) Handle(args []string) {
+	bandwidth := b.proxyService.GetConfig().Bandwidth
+	if len(args) == 0 {
+		fmt.Printf("Connection: %s\n", formatRate(bandwidth.ConnectionBytesPerSecond))
+		fmt.Printf("Host: %s\n", formatRate(bandwidth.HostBytesPerSecond))
+		fmt.Printf("Total: %s\n", formatRate(bandwidth.TotalBytesPerSecond))
+		return
+	}
+	if len(args) < 2 {
+		fmt.Println("\"bandwidth\" needs 2 args, connection, host or total and the bytes per second")
+		return
+	}
+
+	rate, err := parseBytes(args[1])
+	if err != nil {
+		fmt.Printf("Invalid rate \"%s\": %v\n", args[1], err)
+		return
+	}
+	switch args[0] {
+	case "connection":
+		bandwidth.ConnectionBytesPerSecond = rate
+	case "host":
+		bandwidth.HostBytesPerSecond = rate
+	case "total":
+		bandwidth.TotalBytesPerSecond = rate
+	default:
+		fmt.Printf("Unknown limit \"%s\", use connection, host or total\n", args[0])
+		return
+	}
+	b.proxyService.SetBandwidth(bandwidth)
+}
+
+// parseBytes parses an amount of bytes with an optional K, M or G suffix (1024 based)
+func parseBytes(str string) (int64, error) {
+	if str == "" {
+		return 0, errors.New("empty rate")
+	}
+	multiplier := int64(1)
+	switch strings.ToUpper(str[len(str)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		str = str[:len(str)-1]
+	}
+	n, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, errors.New("must not be negative")
+	}
+	if n > math.MaxInt64/multiplier {
+		return 0, errors.New("too large")
+	}
+	return n * multiplier, nil
+}
+
+func formatRate(rate int64) string {
+	if rate == 0 {
+		return "unlimited"
+	}
+	return strconv.FormatInt(rate, 10) + " bytes/s"
+}
@@ -0,0 +1,30 @@
+package cmds
+
+import "testing"
+
+func TestParseBytes(t *testing.T) {
+	for _, test := range []struct {
+		str   string
+		bytes int64
+		ok    bool
+	}{
+		{"0", 0, true},
+		{"512", 512, true},
+		{"512K", 512 << 10, true},
+		{"10m", 10 << 20, true},
+		{"2G", 2 << 30, true},
+		{"8589934591G", 8589934591 << 30, true},
+		{"8589934592G", 0, false},
+		{"9999999999G", 0, false},
+		{"9223372036854775807", 9223372036854775807, true},
+		{"-1K", 0, false},
+		{"K", 0, false},
+		{"", 0, false},
+		{"1T", 0, false},
+	} {
+		bytes, err := parseBytes(test.str)
+		if (err == nil) != test.ok || bytes != test.bytes {
+			t.Errorf("parseBytes(%q) = %d, %v", test.str, bytes, err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package cmds
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/worldOneo/glass-proxy/proxy"
+)
+
+// DrainCmd is a command to gracefully remove a server from the Proxy
+type DrainCmd struct {
+	proxyService proxy.Service
+}
+
+// NewDrainCommand creates a new DrainCmd
+func NewDrainCommand(proxyService proxy.Service) *DrainCmd {
+	return &DrainCmd{
+		proxyService: proxyService,
+	}
+}
+
+// Handle stops new connections to the server and removes it once its connections are closed.
+// The optional timeout (e.g. "30s" or "30" for seconds) force closes the remaining connections.
+func (d *DrainCmd) Handle(args []string) {
+	if len(args) < 1 {
+		fmt.Println("\"drain\" needs at least 1 arg, the name of the server and optionally a timeout")
+		return
+	}
+
+	name := args[0]
+	var timeout time.Duration
+	if len(args) > 1 {
+		var err error
+		timeout, err = parseDuration(args[1])
+		if err != nil {
+			fmt.Printf("Invalid timeout \"%s\": %v\n", args[1], err)
+			return
+		}
+	}
+
+	go func() {
+		if err := d.proxyService.DrainHost(name, timeout); err != nil {
+			fmt.Printf("Couldn't drain %s: %v\n", name, err)
+		}
+	}()
+}
+
+// parseDuration parses a duration like "1m30s" or a plain number of seconds
+func parseDuration(str string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(str); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(str)
+}
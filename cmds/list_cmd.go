@@ -26,8 +26,8 @@ func (l *ListCmd) Handle(args []string) {
 	w.Init(os.Stdout, 8, 8, 0, '\t', 0)
 	defer w.Flush()
 
-	fmt.Fprintf(w, "%s\t|%s\t|%s\t|%s\t|%s\t\n", "Index", "Name", "Address", "Online", "Connections")
+	fmt.Fprintf(w, "%s\t|%s\t|%s\t|%s\t|%s\t|%s\t|%s\t|%s\t\n", "Index", "Name", "Address", "Priority", "Weight", "State", "Online", "Connections")
 	for i, h := range l.proxyService.ListHosts() {
-		fmt.Fprintf(w, "%d\t|%s\t|%s\t|%t\t|%d\t\n", i, h.GetName(), h.GetAddr(), h.GetStatus().IsOnline(), h.GetStatus().GetConnectionCount())
+		fmt.Fprintf(w, "%d\t|%s\t|%s\t|%d\t|%d\t|%s\t|%t\t|%d\t\n", i, h.GetName(), h.GetAddr(), h.GetPriority(), h.GetWeight(), h.GetStatus().GetState(), h.GetStatus().IsOnline(), h.GetStatus().GetConnectionCount())
 	}
 }
@@ -0,0 +1,31 @@
+package cmds
+
+import (
+	"fmt"
+
+	"github.com/worldOneo/glass-proxy/config"
+)
+
+// RollbackCmd restores the previous config and applies it
+type RollbackCmd struct {
+	cnf   string
+	apply func()
+}
+
+// NewRollbackCommand creates a new RollbackCmd which calls apply after the config was restored
+func NewRollbackCommand(confPath string, apply func()) *RollbackCmd {
+	return &RollbackCmd{
+		cnf:   confPath,
+		apply: apply,
+	}
+}
+
+// Handle replaces the config with its newest backup and applies it
+func (r *RollbackCmd) Handle(args []string) {
+	if err := config.Rollback(r.cnf); err != nil {
+		fmt.Printf("Couldn't roll back the config: %v\n", err)
+		return
+	}
+	fmt.Println("Config rolled back")
+	r.apply()
+}
@@ -1,25 +1,26 @@
 package cmds
 
 import (
-	"github.com/worldOneo/glass-proxy/config"
-	"github.com/worldOneo/glass-proxy/proxy"
+	"fmt"
 )
 
 // SaveCmd saves the config
 type SaveCmd struct {
-	proxyService proxy.Service
-	cnf          string
+	save func() error
 }
 
-// NewSaveCommand creates a new save cmf
-func NewSaveCommand(proxyService proxy.Service, confPath string) *SaveCmd {
+// NewSaveCommand creates a new SaveCmd which saves the config with save
+func NewSaveCommand(save func() error) *SaveCmd {
 	return &SaveCmd{
-		cnf:          confPath,
-		proxyService: proxyService,
+		save: save,
 	}
 }
 
-// Handle saves the config
+// Handle saves the config and keeps a backup of the old one
 func (s *SaveCmd) Handle(args []string) {
-	config.Create(s.cnf, s.proxyService.GetConfig())
+	if err := s.save(); err != nil {
+		fmt.Printf("Couldn't save the config: %v\n", err)
+		return
+	}
+	fmt.Println("Config saved")
 }
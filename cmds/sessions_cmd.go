@@ -0,0 +1,65 @@
+package cmds
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/worldOneo/glass-proxy/proxy"
+)
+
+// SessionsCmd is a command to list the sessions of the clients
+type SessionsCmd struct {
+	proxyService proxy.Service
+}
+
+// NewSessionsCommand creates a new SessionsCmd
+func NewSessionsCommand(proxyService proxy.Service) *SessionsCmd {
+	return &SessionsCmd{
+		proxyService: proxyService,
+	}
+}
+
+// truncationCounter is a service which drops datagrams larger than UDPMaxDatagramSize
+type truncationCounter interface {
+	TruncatedDatagrams() uint64
+}
+
+// failoverCounter is a service which moves or closes the sessions of hosts which can't be used anymore
+type failoverCounter interface {
+	Failovers() (moved, closed uint64)
+}
+
+// Handle lists every session with its host, upstream socket and traffic
+// followed by the counters of the service
+func (s *SessionsCmd) Handle(args []string) {
+	defer s.printCounters()
+	sessions := s.proxyService.Sessions()
+	if len(sessions) == 0 {
+		fmt.Println("No sessions")
+		return
+	}
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 8, 8, 0, '\t', 0)
+	defer w.Flush()
+
+	fmt.Fprintf(w, "%s\t|%s\t|%s\t|%s\t|%s\t|%s\t|%s\t\n", "Client", "Server", "Upstream", "Age", "Idle", "Packets (up/down)", "Bytes (up/down)")
+	for _, session := range sessions {
+		age := time.Since(session.Started).Round(time.Second)
+		idle := time.Since(session.LastActive).Round(time.Millisecond)
+		fmt.Fprintf(w, "%s\t|%s\t|%s\t|%s\t|%s\t|%d/%d\t|%d/%d\t\n", session.Client, session.Host+" ("+session.Endpoint+")", session.Upstream, age, idle,
+			session.PacketsUp, session.PacketsDown, session.BytesUp, session.BytesDown)
+	}
+}
+
+// printCounters prints the counters of the service it has
+func (s *SessionsCmd) printCounters() {
+	if counter, ok := s.proxyService.(truncationCounter); ok {
+		fmt.Printf("Dropped datagrams (larger than UDPMaxDatagramSize): %d\n", counter.TruncatedDatagrams())
+	}
+	if counter, ok := s.proxyService.(failoverCounter); ok {
+		moved, closed := counter.Failovers()
+		fmt.Printf("Failed over sessions: %d moved, %d closed\n", moved, closed)
+	}
+}
@@ -0,0 +1,46 @@
+package cmds
+
+import (
+	"fmt"
+
+	"github.com/worldOneo/glass-proxy/config"
+	"github.com/worldOneo/glass-proxy/proxy"
+)
+
+// StateCmd is a command to set the administrative state of a server
+type StateCmd struct {
+	proxyService proxy.Service
+	name         string
+	state        string
+}
+
+// NewEnableCommand creates a new StateCmd which puts a server back into rotation
+func NewEnableCommand(proxyService proxy.Service) *StateCmd {
+	return &StateCmd{
+		proxyService: proxyService,
+		name:         "enable",
+		state:        config.HostEnabled,
+	}
+}
+
+// NewDisableCommand creates a new StateCmd which takes a server out of rotation
+func NewDisableCommand(proxyService proxy.Service) *StateCmd {
+	return &StateCmd{
+		proxyService: proxyService,
+		name:         "disable",
+		state:        config.HostDisabled,
+	}
+}
+
+// Handle sets the state of the server given by name
+func (s *StateCmd) Handle(args []string) {
+	if len(args) < 1 {
+		fmt.Printf("\"%s\" needs 1 arg, the name of the server\n", s.name)
+		return
+	}
+
+	name := args[0]
+	if err := s.proxyService.SetHostState(name, s.state); err != nil {
+		fmt.Printf("Couldn't %s %s: %v\n", s.name, name, err)
+	}
+}
@@ -2,65 +2,223 @@ package config
 
 import (
 	"encoding/json"
-	"flag"
-	"io/ioutil"
 	"os"
+	"runtime"
+	"time"
 )
 
 // Config the configuration for the ProxyService
 type Config struct {
-	Protocol          string       `json:"protocol"`
-	Addr              string       `json:"addr"`
-	Interfaces        []string     `json:"interfaces"`
-	Hosts             []HostConfig `json:"hosts"`
-	LogConfig         LogConfig    `json:"LogConfiguration"`
-	HealthCheckTime   float64      `json:"healthCheckSeconds"`
-	UDPTimeout        int          `json:"UDPTimeout"`
-	SaveConfigOnClose bool         `json:"saveConfigOnClose"`
+	Protocol           string          `json:"protocol" yaml:"protocol" toml:"protocol"`
+	Addr               string          `json:"addr" yaml:"addr" toml:"addr"`
+	Interfaces         []string        `json:"interfaces" yaml:"interfaces" toml:"interfaces"`
+	Listeners          int             `json:"listeners" yaml:"listeners" toml:"listeners"`
+	Hosts              []HostConfig    `json:"hosts" yaml:"hosts" toml:"hosts"`
+	LogConfig          LogConfig       `json:"LogConfiguration" yaml:"LogConfiguration" toml:"LogConfiguration"`
+	HealthCheckTime    float64         `json:"healthCheckSeconds" yaml:"healthCheckSeconds" toml:"healthCheckSeconds"`
+	ResolveSeconds     float64         `json:"resolveSeconds" yaml:"resolveSeconds" toml:"resolveSeconds"`
+	UDPTimeout         int             `json:"UDPTimeout" yaml:"UDPTimeout" toml:"UDPTimeout"`
+	UDPMaxSessions     int             `json:"UDPMaxSessions" yaml:"UDPMaxSessions" toml:"UDPMaxSessions"`
+	UDPFailover        string          `json:"UDPFailover" yaml:"UDPFailover" toml:"UDPFailover"`
+	UDPWorkers         int             `json:"UDPWorkers" yaml:"UDPWorkers" toml:"UDPWorkers"`
+	UDPBatchSize       int             `json:"UDPBatchSize" yaml:"UDPBatchSize" toml:"UDPBatchSize"`
+	UDPMaxDatagramSize int             `json:"UDPMaxDatagramSize" yaml:"UDPMaxDatagramSize" toml:"UDPMaxDatagramSize"`
+	SaveConfigOnClose  bool            `json:"saveConfigOnClose" yaml:"saveConfigOnClose" toml:"saveConfigOnClose"`
+	ShutdownGrace      float64         `json:"shutdownGraceSeconds" yaml:"shutdownGraceSeconds" toml:"shutdownGraceSeconds"`
+	ConfigBackups      int             `json:"configBackups" yaml:"configBackups" toml:"configBackups"`
+	Allow              []string        `json:"allow" yaml:"allow" toml:"allow"`
+	Deny               []string        `json:"deny" yaml:"deny" toml:"deny"`
+	Limits             LimitConfig     `json:"limits" yaml:"limits" toml:"limits"`
+	Bans               BanConfig       `json:"bans" yaml:"bans" toml:"bans"`
+	Bandwidth          BandwidthConfig `json:"bandwidth" yaml:"bandwidth" toml:"bandwidth"`
+	Discovery          DiscoveryConfig `json:"discovery" yaml:"discovery" toml:"discovery"`
 }
 
+// DefaultUDPBatchSize is the amount of UDP datagrams read or written at once if none is configured
+const DefaultUDPBatchSize = 32
+
+// MaxUDPDatagramSize is the largest payload of a UDP datagram over IPv4
+const MaxUDPDatagramSize = 65507
+
+// DefaultUDPMaxDatagramSize is the largest UDP datagram relayed if none is configured,
+// enough for datagrams which aren't fragmented
+const DefaultUDPMaxDatagramSize = 2048
+
+// Administrative states of a host
+const (
+	HostEnabled  = "enabled"
+	HostDisabled = "disabled"
+	HostDraining = "draining"
+)
+
+// Failover policies for the UDP sessions of a host which can't be used anymore
+const (
+	FailoverReassign = "reassign"
+	FailoverClose    = "close"
+)
+
 // HostConfig a config for a specific single host
 type HostConfig struct {
-	Name string `json:"name"`
-	Addr string `json:"addr"`
+	Name     string   `json:"name" yaml:"name" toml:"name"`
+	Addr     string   `json:"addr" yaml:"addr" toml:"addr"`
+	State    string   `json:"state,omitempty" yaml:"state,omitempty" toml:"state,omitempty"`
+	Priority int      `json:"priority,omitempty" yaml:"priority,omitempty" toml:"priority,omitempty"`
+	Weight   int      `json:"weight,omitempty" yaml:"weight,omitempty" toml:"weight,omitempty"`
+	Source   string   `json:"source,omitempty" yaml:"source,omitempty" toml:"source,omitempty"`
+	Tags     []string `json:"tags,omitempty" yaml:"tags,omitempty" toml:"tags,omitempty"`
+}
+
+// GetState returns the administrative state of the host, enabled if none is set
+func (h HostConfig) GetState() string {
+	if h.State == "" {
+		return HostEnabled
+	}
+	return h.State
+}
+
+// GetWeight returns the weight of the host, 1 if none is set
+func (h HostConfig) GetWeight() int {
+	if h.Weight > 0 {
+		return h.Weight
+	}
+	return 1
+}
+
+// IsValidHostState returns if the state is one of the administrative states of a host
+func IsValidHostState(state string) bool {
+	return state == HostEnabled || state == HostDisabled || state == HostDraining
+}
+
+// LimitConfig limits the connections (TCP) or sessions (UDP) of the clients.
+// A value of 0 disables the limit.
+type LimitConfig struct {
+	MaxConnections       int     `json:"maxConnections" yaml:"maxConnections" toml:"maxConnections"`
+	MaxConnectionsPerIP  int     `json:"maxConnectionsPerIP" yaml:"maxConnectionsPerIP" toml:"maxConnectionsPerIP"`
+	ConnectionsPerSecond float64 `json:"connectionsPerSecond" yaml:"connectionsPerSecond" toml:"connectionsPerSecond"`
+	ConnectionBurst      int     `json:"connectionBurst" yaml:"connectionBurst" toml:"connectionBurst"`
+	IPv4Prefix           int     `json:"ipv4Prefix" yaml:"ipv4Prefix" toml:"ipv4Prefix"`
+	IPv6Prefix           int     `json:"ipv6Prefix" yaml:"ipv6Prefix" toml:"ipv6Prefix"`
+}
+
+// BanConfig bans clients which exceed one of the thresholds.
+// A threshold of 0 disables it.
+// The ban duration doubles with every repeated ban of a client up to MaxBanSeconds.
+type BanConfig struct {
+	ConnectionsPerSecond      float64 `json:"connectionsPerSecond" yaml:"connectionsPerSecond" toml:"connectionsPerSecond"`
+	PacketsPerSecond          float64 `json:"packetsPerSecond" yaml:"packetsPerSecond" toml:"packetsPerSecond"`
+	FailedHandshakesPerMinute int     `json:"failedHandshakesPerMinute" yaml:"failedHandshakesPerMinute" toml:"failedHandshakesPerMinute"`
+	BanSeconds                float64 `json:"banSeconds" yaml:"banSeconds" toml:"banSeconds"`
+	MaxBanSeconds             float64 `json:"maxBanSeconds" yaml:"maxBanSeconds" toml:"maxBanSeconds"`
+	File                      string  `json:"file" yaml:"file" toml:"file"`
+}
+
+// BandwidthConfig limits the bytes per second in each direction.
+// A limit of 0 disables it.
+type BandwidthConfig struct {
+	ConnectionBytesPerSecond int64 `json:"connectionBytesPerSecond" yaml:"connectionBytesPerSecond" toml:"connectionBytesPerSecond"`
+	HostBytesPerSecond       int64 `json:"hostBytesPerSecond" yaml:"hostBytesPerSecond" toml:"hostBytesPerSecond"`
+	TotalBytesPerSecond      int64 `json:"totalBytesPerSecond" yaml:"totalBytesPerSecond" toml:"totalBytesPerSecond"`
+}
+
+// DefaultDiscoverySeconds is the time between two discoveries if none is configured
+const DefaultDiscoverySeconds = 30
+
+// DiscoveryConfig discovers hosts in addition to the configured ones.
+// SRV is a DNS SRV name (e.g. "_minecraft._tcp.example.com") looked up at the resolver ("ip:port", the system resolver if empty).
+// Directory is a directory of JSON or YAML files each containing a list of hosts.
+type DiscoveryConfig struct {
+	SRV             string  `json:"srv" yaml:"srv" toml:"srv"`
+	Resolver        string  `json:"resolver" yaml:"resolver" toml:"resolver"`
+	Directory       string  `json:"directory" yaml:"directory" toml:"directory"`
+	IntervalSeconds float64 `json:"intervalSeconds" yaml:"intervalSeconds" toml:"intervalSeconds"`
+}
+
+// GetInterval returns the time between two discoveries
+func (d DiscoveryConfig) GetInterval() time.Duration {
+	if d.IntervalSeconds > 0 {
+		return time.Duration(d.IntervalSeconds * float64(time.Second))
+	}
+	return DefaultDiscoverySeconds * time.Second
 }
 
 // LogConfig defines what should be logged and what not
 type LogConfig struct {
-	LogConnections bool `json:"logConnections"`
-	LogDisconnect  bool `json:"logDisconnect"`
+	LogConnections bool `json:"logConnections" yaml:"logConnections" toml:"logConnections"`
+	LogDisconnect  bool `json:"logDisconnect" yaml:"logDisconnect" toml:"logDisconnect"`
 }
 
-// Load loads a config from the
+// Load loads a config from the path.
+// The format of the file is chosen by its extension.
 func Load(path string) (*Config, error) {
-	configFile, err := os.Open(path)
-	defer configFile.Close()
+	return loadAs(path, FormatOf(path))
+}
+
+// loadAs loads a config from the path in the given format
+func loadAs(path string, format Format) (*Config, error) {
+	data, err := readJSONAs(path, format)
 	if err != nil {
 		return nil, err
 	}
 	var config Config
-	jsonParser := json.NewDecoder(configFile)
-	parseErr := jsonParser.Decode(&config)
-
-	if parseErr != nil {
-		return nil, parseErr
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
 	}
-	config.fillFlags()
 	return &config, nil
 }
 
-// Create creates a config file
-func Create(path string, config *Config) error {
-	data, jsonErr := json.MarshalIndent(config, "", "    ")
-	if jsonErr != nil {
-		return jsonErr
+// LoadHosts loads a list of hosts from the path.
+// The format of the file is chosen by its extension.
+func LoadHosts(path string) ([]HostConfig, error) {
+	data, err := readJSON(path)
+	if err != nil {
+		return nil, err
+	}
+	var hosts []HostConfig
+	if err := json.Unmarshal(data, &hosts); err != nil {
+		return nil, err
 	}
-	writingErr := ioutil.WriteFile(path, data, 0644)
+	return hosts, nil
+}
 
-	if writingErr != nil {
-		return writingErr
+// Watch calls onChange every time the modification time of the file at path changes.
+// Changes written by Save or Rollback of this process are ignored.
+// The file is checked every interval until stop is closed.
+func Watch(path string, interval time.Duration, stop <-chan struct{}, onChange func()) {
+	lastMod := modTime(path)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+		mod := modTime(path)
+		if mod.Equal(lastMod) {
+			continue
+		}
+		lastMod = mod
+		if own, ok := written.Load(path); ok && own.(time.Time).Equal(mod) {
+			continue
+		}
+		onChange()
 	}
-	return nil
+}
+
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// Create creates a config file.
+// The format of the file is chosen by its extension.
+func Create(path string, config *Config) error {
+	data, err := FormatOf(path).Marshal(config)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(path, data)
 }
 
 // Default returns a default config
@@ -78,20 +236,111 @@ func Default() *Config {
 			LogConnections: true,
 			LogDisconnect:  false,
 		},
-		HealthCheckTime:   5,
-		UDPTimeout:        3000,
-		SaveConfigOnClose: false,
-		Interfaces:        []string{},
+		HealthCheckTime:    5,
+		ResolveSeconds:     60,
+		UDPTimeout:         3000,
+		UDPFailover:        FailoverReassign,
+		UDPBatchSize:       DefaultUDPBatchSize,
+		UDPMaxDatagramSize: DefaultUDPMaxDatagramSize,
+		SaveConfigOnClose:  false,
+		ShutdownGrace:      30,
+		ConfigBackups:      5,
+		Allow:              []string{},
+		Deny:               []string{},
+		Interfaces:         []string{},
+		Listeners:          1,
+		Discovery: DiscoveryConfig{
+			IntervalSeconds: DefaultDiscoverySeconds,
+		},
+		Limits: LimitConfig{
+			IPv4Prefix: 32,
+			IPv6Prefix: 128,
+		},
+		Bans: BanConfig{
+			BanSeconds:    60,
+			MaxBanSeconds: 86400,
+		},
 	}
-	conf.fillFlags()
 	return conf
 }
 
-func (c *Config) fillFlags() {
-	flag.BoolVar(&c.LogConfig.LogConnections, "logc", c.LogConfig.LogConnections, "Log connections which where successfully bridged.")
-	flag.BoolVar(&c.LogConfig.LogDisconnect, "logd", c.LogConfig.LogDisconnect, "Log connections which where closed.")
-	flag.BoolVar(&c.SaveConfigOnClose, "save", c.SaveConfigOnClose, "Save the config when the server is stopped.")
-	flag.StringVar(&c.Addr, "addr", c.Addr, "The addr to start the server on.")
-	flag.Float64Var(&c.HealthCheckTime, "health", c.HealthCheckTime, "The time (in seconds) between health checks.")
-	flag.Parse()
+// Clone returns a deep copy of the config
+func (c *Config) Clone() *Config {
+	clone := *c
+	if c.Interfaces != nil {
+		clone.Interfaces = append([]string{}, c.Interfaces...)
+	}
+	if c.Hosts != nil {
+		clone.Hosts = append([]HostConfig{}, c.Hosts...)
+		for i, host := range clone.Hosts {
+			if host.Tags != nil {
+				clone.Hosts[i].Tags = append([]string{}, host.Tags...)
+			}
+		}
+	}
+	if c.Allow != nil {
+		clone.Allow = append([]string{}, c.Allow...)
+	}
+	if c.Deny != nil {
+		clone.Deny = append([]string{}, c.Deny...)
+	}
+	return &clone
+}
+
+// withoutDiscovered returns a copy of the config without the hosts found by discovery (with a Source)
+func (c *Config) withoutDiscovered() *Config {
+	clone := c.Clone()
+	static := clone.Hosts[:0]
+	for _, host := range clone.Hosts {
+		if host.Source == "" {
+			static = append(static, host)
+		}
+	}
+	clone.Hosts = static
+	return clone
+}
+
+// GetListeners returns the amount of sockets listening on the address, at least 1
+func (c *Config) GetListeners() int {
+	if c.Listeners > 1 {
+		return c.Listeners
+	}
+	return 1
+}
+
+// GetUDPFailover returns the failover policy of the UDP sessions, reassign if none is set
+func (c *Config) GetUDPFailover() string {
+	if c.UDPFailover == "" {
+		return FailoverReassign
+	}
+	return c.UDPFailover
+}
+
+// GetUDPWorkers returns the amount of workers handling UDP datagrams, the number of CPUs if none is set
+func (c *Config) GetUDPWorkers() int {
+	if c.UDPWorkers > 0 {
+		return c.UDPWorkers
+	}
+	return runtime.NumCPU()
+}
+
+// GetUDPBatchSize returns the amount of UDP datagrams read or written at once, DefaultUDPBatchSize if none is set
+func (c *Config) GetUDPBatchSize() int {
+	if c.UDPBatchSize > 0 {
+		return c.UDPBatchSize
+	}
+	return DefaultUDPBatchSize
+}
+
+// GetUDPMaxDatagramSize returns the largest UDP datagram relayed, DefaultUDPMaxDatagramSize if none is set
+func (c *Config) GetUDPMaxDatagramSize() int {
+	if c.UDPMaxDatagramSize > 0 {
+		return c.UDPMaxDatagramSize
+	}
+	return DefaultUDPMaxDatagramSize
+}
+
+// GetShutdownGrace returns the time to wait for connections to close on shutdown
+func (c *Config) GetShutdownGrace() time.Duration {
+	return time.Duration(c.ShutdownGrace * float64(time.Second))
 }
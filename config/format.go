@@ -0,0 +1,176 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Format encodes and decodes config files
+type Format interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Supported config formats
+var (
+	JSON Format = jsonFormat{}
+	YAML Format = yamlFormat{}
+	TOML Format = tomlFormat{}
+)
+
+// FormatOf returns the format of the config file by its extension.
+// Files with an unknown extension are JSON.
+func FormatOf(path string) Format {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return YAML
+	case ".toml":
+		return TOML
+	default:
+		return JSON
+	}
+}
+
+// readJSON reads the config file in its format and converts it to JSON
+// so every format is decoded with the same semantics
+func readJSON(path string) ([]byte, error) {
+	return readJSONAs(path, FormatOf(path))
+}
+
+// readJSONAs reads the file in the given format and converts it to JSON
+func readJSONAs(path string, format Format) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if format == JSON {
+		return data, nil
+	}
+	var raw interface{}
+	if err := format.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	return json.Marshal(raw)
+}
+
+type jsonFormat struct{}
+
+func (jsonFormat) Marshal(v interface{}) ([]byte, error) {
+	return json.MarshalIndent(v, "", "    ")
+}
+
+func (jsonFormat) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type yamlFormat struct{}
+
+func (yamlFormat) Marshal(v interface{}) ([]byte, error) {
+	return yaml.Marshal(v)
+}
+
+func (yamlFormat) Unmarshal(data []byte, v interface{}) error {
+	return yaml.Unmarshal(data, v)
+}
+
+type tomlFormat struct{}
+
+func (tomlFormat) Marshal(v interface{}) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	err := toml.NewEncoder(buffer).Encode(v)
+	return buffer.Bytes(), err
+}
+
+func (tomlFormat) Unmarshal(data []byte, v interface{}) error {
+	return toml.Unmarshal(data, v)
+}
+
+// marshalPreserving marshals the config for the file at path.
+// For YAML the values are merged into the existing file to keep its comments.
+func marshalPreserving(path string, config *Config) ([]byte, error) {
+	format := FormatOf(path)
+	if format != YAML {
+		return format.Marshal(config)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return format.Marshal(config)
+	}
+	var old yaml.Node
+	if err := yaml.Unmarshal(data, &old); err != nil || len(old.Content) == 0 {
+		return format.Marshal(config)
+	}
+	var next yaml.Node
+	if err := next.Encode(config); err != nil {
+		return nil, err
+	}
+	mergeYAML(old.Content[0], &next)
+
+	buffer := &bytes.Buffer{}
+	encoder := yaml.NewEncoder(buffer)
+	encoder.SetIndent(4)
+	if err := encoder.Encode(&old); err != nil {
+		return nil, err
+	}
+	err = encoder.Close()
+	return buffer.Bytes(), err
+}
+
+// mergeYAML replaces the values of old with the values of next
+// while keeping the comments of old for values which still exist
+func mergeYAML(old, next *yaml.Node) {
+	if old.Kind != next.Kind {
+		comments := *old
+		*old = *next
+		copyComments(old, &comments)
+		return
+	}
+	switch old.Kind {
+	case yaml.MappingNode:
+		content := make([]*yaml.Node, 0, len(next.Content))
+		for i := 0; i+1 < len(next.Content); i += 2 {
+			key, value := next.Content[i], next.Content[i+1]
+			if oldKey, oldValue := mappingValue(old, key.Value); oldValue != nil {
+				mergeYAML(oldValue, value)
+				key, value = oldKey, oldValue
+			}
+			content = append(content, key, value)
+		}
+		old.Content = content
+	case yaml.SequenceNode:
+		for i, value := range next.Content {
+			if i < len(old.Content) {
+				mergeYAML(old.Content[i], value)
+				next.Content[i] = old.Content[i]
+			}
+		}
+		old.Content = next.Content
+	default:
+		if old.Tag != next.Tag {
+			old.Style = next.Style
+		}
+		old.Value = next.Value
+		old.Tag = next.Tag
+	}
+}
+
+func mappingValue(mapping *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i], mapping.Content[i+1]
+		}
+	}
+	return nil, nil
+}
+
+func copyComments(to, from *yaml.Node) {
+	to.HeadComment = from.HeadComment
+	to.LineComment = from.LineComment
+	to.FootComment = from.FootComment
+}
@@ -0,0 +1,29 @@
+package config
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFormatsRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	conf := Default()
+	conf.Hosts = append(conf.Hosts, HostConfig{Name: "Server-2", Addr: "localhost:25581", State: HostDisabled})
+	for _, name := range []string{"glass.proxy.json", "glass.proxy.yaml", "glass.proxy.yml", "glass.proxy.toml"} {
+		path := filepath.Join(dir, name)
+		if err := Create(path, conf); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		loaded, err := Load(path)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(conf, loaded) {
+			t.Errorf("%s: expected %+v, got %+v", name, conf, loaded)
+		}
+		if err := Check(path); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,478 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix is the prefix of every environment variable overriding a config value
+const EnvPrefix = "GLASS_"
+
+// override describes a config value which can be set by a command line flag and an environment variable
+type override struct {
+	flag   string
+	env    string
+	usage  string
+	isBool bool
+	set    func(c *Config, value string) error
+	get    func(c *Config) string
+	// restore copies the value from one config to another, through get and set if nil
+	restore func(to, from *Config)
+}
+
+var overrides = []override{
+	{
+		flag:  "protocol",
+		env:   "PROTOCOL",
+		usage: "The protocol of the proxy (udp, udp4, udp6, tcp, tcp4, tcp6).",
+		set:   func(c *Config, v string) error { c.Protocol = v; return nil },
+		get:   func(c *Config) string { return c.Protocol },
+	},
+	{
+		flag:  "addr",
+		env:   "ADDR",
+		usage: "The addr to start the server on.",
+		set:   func(c *Config, v string) error { c.Addr = v; return nil },
+		get:   func(c *Config) string { return c.Addr },
+	},
+	{
+		flag:  "interfaces",
+		env:   "INTERFACES",
+		usage: "Comma separated network interfaces to use for outgoing connections.",
+		set:   func(c *Config, v string) error { c.Interfaces = splitList(v); return nil },
+		get:   func(c *Config) string { return strings.Join(c.Interfaces, ",") },
+	},
+	{
+		flag:  "hosts",
+		env:   "HOSTS",
+		usage: "Comma separated hosts as name=addr, replaces the hosts of the config file.",
+		set:   setHosts,
+		get:   getHosts,
+		restore: func(to, from *Config) {
+			to.Hosts = from.Clone().Hosts
+		},
+	},
+	{
+		flag:  "allow",
+		env:   "ALLOW",
+		usage: "Comma separated IPs or CIDRs which may use the proxy, everyone if empty.",
+		set:   func(c *Config, v string) error { c.Allow = splitList(v); return nil },
+		get:   func(c *Config) string { return strings.Join(c.Allow, ",") },
+	},
+	{
+		flag:  "deny",
+		env:   "DENY",
+		usage: "Comma separated IPs or CIDRs which may not use the proxy.",
+		set:   func(c *Config, v string) error { c.Deny = splitList(v); return nil },
+		get:   func(c *Config) string { return strings.Join(c.Deny, ",") },
+	},
+	{
+		flag:   "logc",
+		env:    "LOG_CONNECTIONS",
+		usage:  "Log connections which where successfully bridged.",
+		isBool: true,
+		set:    boolSetter(func(c *Config) *bool { return &c.LogConfig.LogConnections }),
+		get:    func(c *Config) string { return strconv.FormatBool(c.LogConfig.LogConnections) },
+	},
+	{
+		flag:   "logd",
+		env:    "LOG_DISCONNECT",
+		usage:  "Log connections which where closed.",
+		isBool: true,
+		set:    boolSetter(func(c *Config) *bool { return &c.LogConfig.LogDisconnect }),
+		get:    func(c *Config) string { return strconv.FormatBool(c.LogConfig.LogDisconnect) },
+	},
+	{
+		flag:  "health",
+		env:   "HEALTH_CHECK_SECONDS",
+		usage: "The time (in seconds) between health checks.",
+		set:   floatSetter(func(c *Config) *float64 { return &c.HealthCheckTime }),
+		get:   func(c *Config) string { return strconv.FormatFloat(c.HealthCheckTime, 'g', -1, 64) },
+	},
+	{
+		flag:  "udptimeout",
+		env:   "UDP_TIMEOUT",
+		usage: "The time (in ms) until a UDP connection is considered as closed.",
+		set: func(c *Config, v string) error {
+			timeout, err := strconv.Atoi(v)
+			c.UDPTimeout = timeout
+			return err
+		},
+		get: func(c *Config) string { return strconv.Itoa(c.UDPTimeout) },
+	},
+	{
+		flag:   "save",
+		env:    "SAVE_CONFIG_ON_CLOSE",
+		usage:  "Save the config when the server is stopped.",
+		isBool: true,
+		set:    boolSetter(func(c *Config) *bool { return &c.SaveConfigOnClose }),
+		get:    func(c *Config) string { return strconv.FormatBool(c.SaveConfigOnClose) },
+	},
+	{
+		flag:  "grace",
+		env:   "SHUTDOWN_GRACE_SECONDS",
+		usage: "The time (in seconds) to wait for connections to close on shutdown.",
+		set:   floatSetter(func(c *Config) *float64 { return &c.ShutdownGrace }),
+		get:   func(c *Config) string { return strconv.FormatFloat(c.ShutdownGrace, 'g', -1, 64) },
+	},
+	{
+		flag:  "backups",
+		env:   "CONFIG_BACKUPS",
+		usage: "The amount of backups to keep when the config is saved.",
+		set: func(c *Config, v string) error {
+			backups, err := strconv.Atoi(v)
+			c.ConfigBackups = backups
+			return err
+		},
+		get: func(c *Config) string { return strconv.Itoa(c.ConfigBackups) },
+	},
+	{
+		flag:  "maxconn",
+		env:   "MAX_CONNECTIONS",
+		usage: "The maximum amount of open client connections, unlimited if 0.",
+		set: func(c *Config, v string) error {
+			max, err := strconv.Atoi(v)
+			c.Limits.MaxConnections = max
+			return err
+		},
+		get: func(c *Config) string { return strconv.Itoa(c.Limits.MaxConnections) },
+	},
+	{
+		flag:  "maxconnip",
+		env:   "MAX_CONNECTIONS_PER_IP",
+		usage: "The maximum amount of open connections of a client, unlimited if 0.",
+		set: func(c *Config, v string) error {
+			max, err := strconv.Atoi(v)
+			c.Limits.MaxConnectionsPerIP = max
+			return err
+		},
+		get: func(c *Config) string { return strconv.Itoa(c.Limits.MaxConnectionsPerIP) },
+	},
+	{
+		flag:  "connrate",
+		env:   "CONNECTIONS_PER_SECOND",
+		usage: "The amount of new connections per second a client may open, unlimited if 0.",
+		set:   floatSetter(func(c *Config) *float64 { return &c.Limits.ConnectionsPerSecond }),
+		get:   func(c *Config) string { return strconv.FormatFloat(c.Limits.ConnectionsPerSecond, 'g', -1, 64) },
+	},
+	{
+		flag:  "connburst",
+		env:   "CONNECTION_BURST",
+		usage: "The amount of new connections a client may open at once before it is rate limited.",
+		set:   intSetter(func(c *Config) *int { return &c.Limits.ConnectionBurst }),
+		get:   func(c *Config) string { return strconv.Itoa(c.Limits.ConnectionBurst) },
+	},
+	{
+		flag:  "ipv4prefix",
+		env:   "IPV4_PREFIX",
+		usage: "The prefix length IPv4 clients are grouped by for the limits.",
+		set:   intSetter(func(c *Config) *int { return &c.Limits.IPv4Prefix }),
+		get:   func(c *Config) string { return strconv.Itoa(c.Limits.IPv4Prefix) },
+	},
+	{
+		flag:  "ipv6prefix",
+		env:   "IPV6_PREFIX",
+		usage: "The prefix length IPv6 clients are grouped by for the limits.",
+		set:   intSetter(func(c *Config) *int { return &c.Limits.IPv6Prefix }),
+		get:   func(c *Config) string { return strconv.Itoa(c.Limits.IPv6Prefix) },
+	},
+	{
+		flag:  "banconnrate",
+		env:   "BAN_CONNECTIONS_PER_SECOND",
+		usage: "Ban a client which opens more TCP connections per second, never if 0.",
+		set:   floatSetter(func(c *Config) *float64 { return &c.Bans.ConnectionsPerSecond }),
+		get:   func(c *Config) string { return strconv.FormatFloat(c.Bans.ConnectionsPerSecond, 'g', -1, 64) },
+	},
+	{
+		flag:  "banpacketrate",
+		env:   "BAN_PACKETS_PER_SECOND",
+		usage: "Ban a client which sends more UDP datagrams per second, never if 0.",
+		set:   floatSetter(func(c *Config) *float64 { return &c.Bans.PacketsPerSecond }),
+		get:   func(c *Config) string { return strconv.FormatFloat(c.Bans.PacketsPerSecond, 'g', -1, 64) },
+	},
+	{
+		flag:  "banhandshakes",
+		env:   "BAN_FAILED_HANDSHAKES_PER_MINUTE",
+		usage: "Ban a client which closes more TCP connections per minute without sending anything, never if 0.",
+		set:   intSetter(func(c *Config) *int { return &c.Bans.FailedHandshakesPerMinute }),
+		get:   func(c *Config) string { return strconv.Itoa(c.Bans.FailedHandshakesPerMinute) },
+	},
+	{
+		flag:  "banseconds",
+		env:   "BAN_SECONDS",
+		usage: "The time (in seconds) a client is banned the first time.",
+		set:   floatSetter(func(c *Config) *float64 { return &c.Bans.BanSeconds }),
+		get:   func(c *Config) string { return strconv.FormatFloat(c.Bans.BanSeconds, 'g', -1, 64) },
+	},
+	{
+		flag:  "maxbanseconds",
+		env:   "MAX_BAN_SECONDS",
+		usage: "The maximum time (in seconds) a client is banned.",
+		set:   floatSetter(func(c *Config) *float64 { return &c.Bans.MaxBanSeconds }),
+		get:   func(c *Config) string { return strconv.FormatFloat(c.Bans.MaxBanSeconds, 'g', -1, 64) },
+	},
+	{
+		flag:  "banfile",
+		env:   "BAN_FILE",
+		usage: "A file to keep the bans in across restarts, not kept if empty.",
+		set:   func(c *Config, v string) error { c.Bans.File = v; return nil },
+		get:   func(c *Config) string { return c.Bans.File },
+	},
+	{
+		flag:  "connbandwidth",
+		env:   "CONNECTION_BYTES_PER_SECOND",
+		usage: "The bytes per second of one connection or session in each direction, unlimited if 0.",
+		set:   int64Setter(func(c *Config) *int64 { return &c.Bandwidth.ConnectionBytesPerSecond }),
+		get:   func(c *Config) string { return strconv.FormatInt(c.Bandwidth.ConnectionBytesPerSecond, 10) },
+	},
+	{
+		flag:  "hostbandwidth",
+		env:   "HOST_BYTES_PER_SECOND",
+		usage: "The bytes per second of all connections to one host in each direction, unlimited if 0.",
+		set:   int64Setter(func(c *Config) *int64 { return &c.Bandwidth.HostBytesPerSecond }),
+		get:   func(c *Config) string { return strconv.FormatInt(c.Bandwidth.HostBytesPerSecond, 10) },
+	},
+	{
+		flag:  "totalbandwidth",
+		env:   "TOTAL_BYTES_PER_SECOND",
+		usage: "The bytes per second of all connections of the proxy in each direction, unlimited if 0.",
+		set:   int64Setter(func(c *Config) *int64 { return &c.Bandwidth.TotalBytesPerSecond }),
+		get:   func(c *Config) string { return strconv.FormatInt(c.Bandwidth.TotalBytesPerSecond, 10) },
+	},
+	{
+		flag:  "udpworkers",
+		env:   "UDP_WORKERS",
+		usage: "The amount of workers relaying UDP datagrams, one per CPU if 0.",
+		set:   intSetter(func(c *Config) *int { return &c.UDPWorkers }),
+		get:   func(c *Config) string { return strconv.Itoa(c.UDPWorkers) },
+	},
+	{
+		flag:  "udpbatch",
+		env:   "UDP_BATCH_SIZE",
+		usage: "The amount of UDP datagrams read or written at once.",
+		set:   intSetter(func(c *Config) *int { return &c.UDPBatchSize }),
+		get:   func(c *Config) string { return strconv.Itoa(c.UDPBatchSize) },
+	},
+	{
+		flag:  "udpdatagram",
+		env:   "UDP_MAX_DATAGRAM_SIZE",
+		usage: "The largest UDP datagram (in bytes) relayed, larger ones are dropped.",
+		set:   intSetter(func(c *Config) *int { return &c.UDPMaxDatagramSize }),
+		get:   func(c *Config) string { return strconv.Itoa(c.UDPMaxDatagramSize) },
+	},
+	{
+		flag:  "listeners",
+		env:   "LISTENERS",
+		usage: "The amount of sockets listening on the addr, with SO_REUSEPORT if more than 1.",
+		set:   intSetter(func(c *Config) *int { return &c.Listeners }),
+		get:   func(c *Config) string { return strconv.Itoa(c.Listeners) },
+	},
+	{
+		flag:  "udpsessions",
+		env:   "UDP_MAX_SESSIONS",
+		usage: "The maximum amount of UDP sessions, unlimited if 0.",
+		set:   intSetter(func(c *Config) *int { return &c.UDPMaxSessions }),
+		get:   func(c *Config) string { return strconv.Itoa(c.UDPMaxSessions) },
+	},
+	{
+		flag:  "udpfailover",
+		env:   "UDP_FAILOVER",
+		usage: "What happens to the UDP sessions of a server which can't be used anymore (reassign, close).",
+		set:   func(c *Config, v string) error { c.UDPFailover = v; return nil },
+		get:   func(c *Config) string { return c.UDPFailover },
+	},
+	{
+		flag:  "resolve",
+		env:   "RESOLVE_SECONDS",
+		usage: "The time (in seconds) between lookups of the server host names, only at start if 0.",
+		set:   floatSetter(func(c *Config) *float64 { return &c.ResolveSeconds }),
+		get:   func(c *Config) string { return strconv.FormatFloat(c.ResolveSeconds, 'g', -1, 64) },
+	},
+	{
+		flag:  "srv",
+		env:   "DISCOVERY_SRV",
+		usage: "A DNS SRV name whose targets are added as hosts, no discovery if empty.",
+		set:   func(c *Config, v string) error { c.Discovery.SRV = v; return nil },
+		get:   func(c *Config) string { return c.Discovery.SRV },
+	},
+	{
+		flag:  "srvresolver",
+		env:   "DISCOVERY_RESOLVER",
+		usage: "The DNS server (ip:port) the SRV name is looked up at, the system resolver if empty.",
+		set:   func(c *Config, v string) error { c.Discovery.Resolver = v; return nil },
+		get:   func(c *Config) string { return c.Discovery.Resolver },
+	},
+	{
+		flag:  "discoveryinterval",
+		env:   "DISCOVERY_INTERVAL_SECONDS",
+		usage: "The time (in seconds) between two discoveries.",
+		set:   floatSetter(func(c *Config) *float64 { return &c.Discovery.IntervalSeconds }),
+		get:   func(c *Config) string { return strconv.FormatFloat(c.Discovery.IntervalSeconds, 'g', -1, 64) },
+	},
+	{
+		flag:  "discoverydir",
+		env:   "DISCOVERY_DIRECTORY",
+		usage: "A directory of JSON or YAML host files whose hosts are added, no discovery if empty.",
+		set:   func(c *Config, v string) error { c.Discovery.Directory = v; return nil },
+		get:   func(c *Config) string { return c.Discovery.Directory },
+	},
+}
+
+// ApplyEnv overrides the config values with the environment variables found by lookup (e.g. os.LookupEnv)
+func (c *Config) ApplyEnv(lookup func(string) (string, bool)) error {
+	for _, o := range overrides {
+		value, ok := lookup(EnvPrefix + o.env)
+		if !ok {
+			continue
+		}
+		if err := o.set(c, value); err != nil {
+			return fmt.Errorf("invalid value \"%s\" for %s%s: %v", value, EnvPrefix, o.env, err)
+		}
+	}
+	return nil
+}
+
+// WithoutOverrides returns a copy of the config whose values set by the environment variables found by lookup
+// or by the flags are replaced by the values of file, e.g. to save only the values which came from the config file
+func (c *Config) WithoutOverrides(file *Config, lookup func(string) (string, bool), flags *Flags) *Config {
+	clone := c.Clone()
+	for _, o := range overrides {
+		_, env := lookup(EnvPrefix + o.env)
+		flag := false
+		if flags != nil {
+			_, flag = flags.values[o.flag]
+		}
+		if !env && !flag {
+			continue
+		}
+		if o.restore != nil {
+			o.restore(clone, file)
+		} else {
+			o.set(clone, o.get(file))
+		}
+	}
+	return clone
+}
+
+// Flags holds the config values given as command line flags
+type Flags struct {
+	values map[string]string
+}
+
+// RegisterFlags registers a flag for every config value on the FlagSet.
+// The parsed values are applied with Flags.Apply.
+func RegisterFlags(fs *flag.FlagSet) *Flags {
+	flags := &Flags{
+		values: make(map[string]string),
+	}
+	defaults := Default()
+	for _, o := range overrides {
+		fs.Var(&flagValue{flags: flags, override: o, value: o.get(defaults)}, o.flag,
+			o.usage+" (env "+EnvPrefix+o.env+")")
+	}
+	return flags
+}
+
+// Apply overrides the config values with the given flags
+func (f *Flags) Apply(c *Config) error {
+	for _, o := range overrides {
+		value, ok := f.values[o.flag]
+		if !ok {
+			continue
+		}
+		if err := o.set(c, value); err != nil {
+			return fmt.Errorf("invalid value \"%s\" for -%s: %v", value, o.flag, err)
+		}
+	}
+	return nil
+}
+
+// flagValue is a flag.Value which stores the value to apply it later
+type flagValue struct {
+	flags    *Flags
+	override override
+	value    string
+}
+
+func (v *flagValue) String() string {
+	return v.value
+}
+
+func (v *flagValue) Set(value string) error {
+	if err := v.override.set(&Config{}, value); err != nil {
+		return err
+	}
+	v.value = value
+	v.flags.values[v.override.flag] = value
+	return nil
+}
+
+func (v *flagValue) IsBoolFlag() bool {
+	return v.override.isBool
+}
+
+func boolSetter(field func(c *Config) *bool) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		*field(c) = b
+		return err
+	}
+}
+
+func intSetter(field func(c *Config) *int) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		i, err := strconv.Atoi(value)
+		*field(c) = i
+		return err
+	}
+}
+
+func int64Setter(field func(c *Config) *int64) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		i, err := strconv.ParseInt(value, 10, 64)
+		*field(c) = i
+		return err
+	}
+}
+
+func floatSetter(field func(c *Config) *float64) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		f, err := strconv.ParseFloat(value, 64)
+		*field(c) = f
+		return err
+	}
+}
+
+func splitList(value string) []string {
+	list := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func setHosts(c *Config, value string) error {
+	hosts := make([]HostConfig, 0)
+	for _, item := range splitList(value) {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return errors.New("host \"" + item + "\" isn't in the format name=addr")
+		}
+		hosts = append(hosts, HostConfig{Name: parts[0], Addr: parts[1]})
+	}
+	c.Hosts = hosts
+	return nil
+}
+
+func getHosts(c *Config) string {
+	hosts := make([]string, len(c.Hosts))
+	for i, host := range c.Hosts {
+		hosts[i] = host.Name + "=" + host.Addr
+	}
+	return strings.Join(hosts, ",")
+}
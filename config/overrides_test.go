@@ -0,0 +1,148 @@
+package config
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+)
+
+func TestOverridePrecedence(t *testing.T) {
+	fs := flag.NewFlagSet("glass-proxy", flag.ContinueOnError)
+	flags := RegisterFlags(fs)
+	if err := fs.Parse([]string{"-addr", "127.0.0.1:1000", "-logd"}); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"GLASS_ADDR":                 "127.0.0.1:2000",
+		"GLASS_HEALTH_CHECK_SECONDS": "2.5",
+		"GLASS_HOSTS":                "a=localhost:1,b=localhost:2",
+	}
+	lookup := func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+
+	conf := Default()
+	if err := conf.ApplyEnv(lookup); err != nil {
+		t.Fatal(err)
+	}
+	if err := flags.Apply(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	if conf.Addr != "127.0.0.1:1000" {
+		t.Errorf("flag should override env, got addr %s", conf.Addr)
+	}
+	if conf.HealthCheckTime != 2.5 {
+		t.Errorf("env should override file, got healthCheckSeconds %v", conf.HealthCheckTime)
+	}
+	if !conf.LogConfig.LogDisconnect || !conf.LogConfig.LogConnections {
+		t.Errorf("unexpected log config %+v", conf.LogConfig)
+	}
+	if len(conf.Hosts) != 2 || conf.Hosts[1].Name != "b" || conf.Hosts[1].Addr != "localhost:2" {
+		t.Errorf("unexpected hosts %+v", conf.Hosts)
+	}
+	if conf.Protocol != "tcp" {
+		t.Errorf("unset values should stay, got protocol %s", conf.Protocol)
+	}
+}
+
+func TestApplyEnvRejectsInvalidValues(t *testing.T) {
+	conf := Default()
+	err := conf.ApplyEnv(func(key string) (string, bool) {
+		return "often", key == "GLASS_UDP_TIMEOUT"
+	})
+	if err == nil {
+		t.Fatal("expected an error for GLASS_UDP_TIMEOUT=often")
+	}
+}
+
+func TestWithoutOverrides(t *testing.T) {
+	fs := flag.NewFlagSet("glass-proxy", flag.ContinueOnError)
+	flags := RegisterFlags(fs)
+	if err := fs.Parse([]string{"-addr", "127.0.0.1:1000"}); err != nil {
+		t.Fatal(err)
+	}
+	lookup := func(key string) (string, bool) {
+		return "a=localhost:1", key == "GLASS_HOSTS"
+	}
+	file := Default()
+	file.Hosts[0].State = HostDisabled
+
+	conf := file.Clone()
+	if err := conf.ApplyEnv(lookup); err != nil {
+		t.Fatal(err)
+	}
+	if err := flags.Apply(conf); err != nil {
+		t.Fatal(err)
+	}
+	conf.HealthCheckTime = 7
+
+	saved := conf.WithoutOverrides(file, lookup, flags)
+	if saved.Addr != file.Addr || !reflect.DeepEqual(saved.Hosts, file.Hosts) {
+		t.Errorf("overridden values are saved: addr %s, hosts %+v", saved.Addr, saved.Hosts)
+	}
+	if saved.HealthCheckTime != 7 {
+		t.Errorf("changed value isn't saved, got healthCheckSeconds %v", saved.HealthCheckTime)
+	}
+	if conf.Addr != "127.0.0.1:1000" {
+		t.Errorf("the config itself changed to addr %s", conf.Addr)
+	}
+}
+
+func TestEveryOverride(t *testing.T) {
+	for _, test := range []struct {
+		flag  string
+		env   string
+		value string
+		get   func(c *Config) interface{}
+		want  interface{}
+	}{
+		{"connburst", "CONNECTION_BURST", "5", func(c *Config) interface{} { return c.Limits.ConnectionBurst }, 5},
+		{"ipv4prefix", "IPV4_PREFIX", "24", func(c *Config) interface{} { return c.Limits.IPv4Prefix }, 24},
+		{"ipv6prefix", "IPV6_PREFIX", "64", func(c *Config) interface{} { return c.Limits.IPv6Prefix }, 64},
+		{"banconnrate", "BAN_CONNECTIONS_PER_SECOND", "20", func(c *Config) interface{} { return c.Bans.ConnectionsPerSecond }, 20.0},
+		{"banpacketrate", "BAN_PACKETS_PER_SECOND", "500", func(c *Config) interface{} { return c.Bans.PacketsPerSecond }, 500.0},
+		{"banhandshakes", "BAN_FAILED_HANDSHAKES_PER_MINUTE", "10", func(c *Config) interface{} { return c.Bans.FailedHandshakesPerMinute }, 10},
+		{"banseconds", "BAN_SECONDS", "60", func(c *Config) interface{} { return c.Bans.BanSeconds }, 60.0},
+		{"maxbanseconds", "MAX_BAN_SECONDS", "3600", func(c *Config) interface{} { return c.Bans.MaxBanSeconds }, 3600.0},
+		{"banfile", "BAN_FILE", "bans.json", func(c *Config) interface{} { return c.Bans.File }, "bans.json"},
+		{"connbandwidth", "CONNECTION_BYTES_PER_SECOND", "65536", func(c *Config) interface{} { return c.Bandwidth.ConnectionBytesPerSecond }, int64(65536)},
+		{"hostbandwidth", "HOST_BYTES_PER_SECOND", "1048576", func(c *Config) interface{} { return c.Bandwidth.HostBytesPerSecond }, int64(1048576)},
+		{"totalbandwidth", "TOTAL_BYTES_PER_SECOND", "10485760", func(c *Config) interface{} { return c.Bandwidth.TotalBytesPerSecond }, int64(10485760)},
+		{"udpworkers", "UDP_WORKERS", "8", func(c *Config) interface{} { return c.UDPWorkers }, 8},
+		{"udpbatch", "UDP_BATCH_SIZE", "64", func(c *Config) interface{} { return c.UDPBatchSize }, 64},
+		{"udpdatagram", "UDP_MAX_DATAGRAM_SIZE", "1500", func(c *Config) interface{} { return c.UDPMaxDatagramSize }, 1500},
+		{"listeners", "LISTENERS", "4", func(c *Config) interface{} { return c.Listeners }, 4},
+		{"udpsessions", "UDP_MAX_SESSIONS", "1000", func(c *Config) interface{} { return c.UDPMaxSessions }, 1000},
+		{"udpfailover", "UDP_FAILOVER", "close", func(c *Config) interface{} { return c.UDPFailover }, FailoverClose},
+		{"resolve", "RESOLVE_SECONDS", "120", func(c *Config) interface{} { return c.ResolveSeconds }, 120.0},
+		{"srv", "DISCOVERY_SRV", "_minecraft._tcp.example.com", func(c *Config) interface{} { return c.Discovery.SRV }, "_minecraft._tcp.example.com"},
+		{"srvresolver", "DISCOVERY_RESOLVER", "10.0.0.53:53", func(c *Config) interface{} { return c.Discovery.Resolver }, "10.0.0.53:53"},
+		{"discoveryinterval", "DISCOVERY_INTERVAL_SECONDS", "10", func(c *Config) interface{} { return c.Discovery.IntervalSeconds }, 10.0},
+		{"discoverydir", "DISCOVERY_DIRECTORY", "/etc/glass/hosts.d", func(c *Config) interface{} { return c.Discovery.Directory }, "/etc/glass/hosts.d"},
+	} {
+		conf := Default()
+		err := conf.ApplyEnv(func(key string) (string, bool) {
+			return test.value, key == EnvPrefix+test.env
+		})
+		if err != nil {
+			t.Errorf("%s%s: %v", EnvPrefix, test.env, err)
+		} else if got := test.get(conf); got != test.want {
+			t.Errorf("%s%s=%s set %v, expected %v", EnvPrefix, test.env, test.value, got, test.want)
+		}
+
+		fs := flag.NewFlagSet("glass-proxy", flag.ContinueOnError)
+		flags := RegisterFlags(fs)
+		if err := fs.Parse([]string{"-" + test.flag, test.value}); err != nil {
+			t.Errorf("-%s: %v", test.flag, err)
+			continue
+		}
+		conf = Default()
+		if err := flags.Apply(conf); err != nil {
+			t.Errorf("-%s: %v", test.flag, err)
+		} else if got := test.get(conf); got != test.want {
+			t.Errorf("-%s %s set %v, expected %v", test.flag, test.value, got, test.want)
+		}
+	}
+}
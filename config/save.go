@@ -0,0 +1,155 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is the timestamp format of backup file names, sortable by time
+const backupTimeFormat = "20060102-150405.000"
+
+var saveLock sync.Mutex
+
+// written holds the modification times of the config files written by this process,
+// Watch doesn't report them as changes
+var written sync.Map
+
+// Save writes the config atomically to path and keeps up to backups
+// timestamped copies of the replaced versions next to it.
+// Hosts found by discovery aren't saved, they are discovered again.
+// Concurrent saves are serialized by a lock file (path.lock).
+func Save(path string, config *Config, backups int) error {
+	return withLock(path, func() error {
+		data, err := marshalPreserving(path, config.withoutDiscovered())
+		if err != nil {
+			return err
+		}
+		old, err := ioutil.ReadFile(path)
+		if err == nil {
+			if bytes.Equal(old, data) {
+				return nil
+			}
+			if backups > 0 {
+				if err := writeAtomic(nextBackupPath(path), old); err != nil {
+					return err
+				}
+			}
+		}
+		if err := writeAtomic(path, data); err != nil {
+			return err
+		}
+		written.Store(path, modTime(path))
+		return pruneBackups(path, backups)
+	})
+}
+
+// Rollback replaces the config at path with its newest backup.
+// The backup is consumed so repeated rollbacks go further back.
+func Rollback(path string) error {
+	return withLock(path, func() error {
+		backups, err := Backups(path)
+		if err != nil {
+			return err
+		}
+		if len(backups) == 0 {
+			return errors.New("no backup of " + path + " found")
+		}
+		newest := backups[len(backups)-1]
+		if _, err := loadAs(newest, FormatOf(path)); err != nil {
+			return errors.New("backup " + newest + " is unreadable: " + err.Error())
+		}
+		if err := os.Rename(newest, path); err != nil {
+			return err
+		}
+		written.Store(path, modTime(path))
+		return nil
+	})
+}
+
+// Backups returns the backup files of the config at path, the oldest first
+func Backups(path string) ([]string, error) {
+	backups, err := filepath.Glob(path + ".*.bak")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+func backupPath(path string, t time.Time) string {
+	return path + "." + t.Format(backupTimeFormat) + ".bak"
+}
+
+// nextBackupPath returns the path for a new backup which doesn't replace
+// a backup made in the same millisecond
+func nextBackupPath(path string) string {
+	t := time.Now()
+	for {
+		backup := backupPath(path, t)
+		if _, err := os.Stat(backup); os.IsNotExist(err) {
+			return backup
+		}
+		t = t.Add(time.Millisecond)
+	}
+}
+
+func pruneBackups(path string, keep int) error {
+	backups, err := Backups(path)
+	if err != nil {
+		return err
+	}
+	for len(backups) > keep {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// writeAtomic writes the data to a temporary file next to path and renames it to path
+// so path always holds either the old or the new data
+func writeAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// withLock runs f while holding the lock of the config at path
+func withLock(path string, f func() error) error {
+	saveLock.Lock()
+	defer saveLock.Unlock()
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := lockFile(lock); err != nil {
+		return err
+	}
+	defer unlockFile(lock)
+	return f()
+}
@@ -0,0 +1,129 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSaveKeepsBackupsAndRollsBack(t *testing.T) {
+	for _, name := range []string{"glass.proxy.json", "glass.proxy.yaml", "glass.proxy.yml", "glass.proxy.toml"} {
+		path := filepath.Join(t.TempDir(), name)
+		conf := Default()
+		for i := 0; i < 4; i++ {
+			conf.UDPTimeout = 1000 + i
+			if err := Save(path, conf, 2); err != nil {
+				t.Fatal(err)
+			}
+		}
+		backups, err := Backups(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(backups) != 2 {
+			t.Fatalf("%s: expected 2 backups, got %v", name, backups)
+		}
+
+		if err := Rollback(path); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		loaded, err := Load(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.UDPTimeout != 1002 {
+			t.Errorf("%s: expected the previous version, got UDPTimeout %d", name, loaded.UDPTimeout)
+		}
+	}
+}
+
+func TestSaveKeepsYAMLComments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "glass.proxy.yaml")
+	data := `# glass proxy
+protocol: tcp # only tcp for now
+addr: 0.0.0.0:25565
+hosts:
+    # the main server
+    - name: Server-1
+      addr: localhost:25580
+healthCheckSeconds: 5
+`
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.Addr = "0.0.0.0:25566"
+	conf.Hosts = append(conf.Hosts, HostConfig{Name: "Server-2", Addr: "localhost:25581"})
+	if err := Save(path, conf, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"# glass proxy", "# only tcp for now", "# the main server", "0.0.0.0:25566", "Server-2"} {
+		if !strings.Contains(string(saved), expected) {
+			t.Errorf("missing %q in:\n%s", expected, saved)
+		}
+	}
+}
+
+func TestWatchIgnoresOwnSaves(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "glass.proxy.json")
+	if err := Save(path, Default(), 0); err != nil {
+		t.Fatal(err)
+	}
+	changes := make(chan struct{}, 10)
+	stop := make(chan struct{})
+	defer close(stop)
+	go Watch(path, 10*time.Millisecond, stop, func() { changes <- struct{}{} })
+
+	time.Sleep(50 * time.Millisecond)
+	conf := Default()
+	conf.UDPTimeout = 1234
+	if err := Save(path, conf, 0); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changes:
+		t.Fatal("own save reported as change")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"protocol": "udp"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changes:
+	case <-time.After(time.Second):
+		t.Fatal("external change not reported")
+	}
+}
+
+func TestSaveSkipsDiscoveredHosts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "glass.proxy.json")
+	conf := Default()
+	conf.Hosts = []HostConfig{
+		{Name: "static", Addr: "localhost:25580"},
+		{Name: "found", Addr: "backend:25580", Source: "srv:_minecraft._tcp.example.com"},
+	}
+	if err := Save(path, conf, 0); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Hosts) != 1 || loaded.Hosts[0].Name != "static" {
+		t.Errorf("expected only the static host to be saved, got %+v", loaded.Hosts)
+	}
+	if len(conf.Hosts) != 2 {
+		t.Errorf("saving removed the discovered host from the config: %+v", conf.Hosts)
+	}
+}
@@ -0,0 +1,335 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/worldOneo/glass-proxy/access"
+)
+
+// FieldError is a problem with a single value of the config
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidationErrors holds every problem found in a config
+type ValidationErrors []FieldError
+
+func (e ValidationErrors) Error() string {
+	problems := make([]string, len(e))
+	for i, err := range e {
+		problems[i] = err.Error()
+	}
+	return strings.Join(problems, "\n")
+}
+
+// IsValidProtocol returns if the proxy supports the protocol
+func IsValidProtocol(protocol string) bool {
+	switch strings.ToLower(protocol) {
+	case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6":
+		return true
+	}
+	return false
+}
+
+// Check reads the config at path and reports every problem
+// including keys which aren't part of the config
+func Check(path string) error {
+	_, err := Read(path, nil)
+	return err
+}
+
+// Read loads the config at path and applies apply (e.g. the overrides) if it isn't nil.
+// Every problem of the result is reported, including keys of the file which aren't part of the config.
+func Read(path string, apply func(*Config) error) (*Config, error) {
+	data, err := readJSON(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	problems := unknownKeys("", raw, reflect.TypeOf(Config{}))
+
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	if apply != nil {
+		if err := apply(&config); err != nil {
+			return nil, err
+		}
+	}
+	if err := config.Validate(); err != nil {
+		problems = append(problems, err.(ValidationErrors)...)
+	}
+	if len(problems) > 0 {
+		return nil, problems
+	}
+	return &config, nil
+}
+
+// Validate checks the config for values the proxy can't run with.
+// It returns ValidationErrors with every problem found or nil.
+func (c *Config) Validate() error {
+	problems := make(ValidationErrors, 0)
+	add := func(field, format string, args ...interface{}) {
+		problems = append(problems, FieldError{field, fmt.Sprintf(format, args...)})
+	}
+
+	protocol := strings.ToLower(c.Protocol)
+	validProtocol := IsValidProtocol(protocol)
+	if !validProtocol {
+		add("protocol", "invalid protocol \"%s\". supported: udp, udp4, udp6, tcp, tcp4, tcp6", c.Protocol)
+	}
+	if err := validateAddr(protocol, c.Addr, validProtocol, true); err != nil {
+		add("addr", "%v", err)
+	}
+
+	for i, name := range c.Interfaces {
+		if _, err := net.InterfaceByName(name); err != nil {
+			add(fmt.Sprintf("interfaces[%d]", i), "unknown network interface \"%s\"", name)
+		}
+	}
+
+	for i, entry := range c.Allow {
+		if _, err := access.ParseCIDR(entry); err != nil {
+			add(fmt.Sprintf("allow[%d]", i), "%v", err)
+		}
+	}
+	for i, entry := range c.Deny {
+		if _, err := access.ParseCIDR(entry); err != nil {
+			add(fmt.Sprintf("deny[%d]", i), "%v", err)
+		}
+	}
+
+	limits := c.Limits
+	if limits.MaxConnections < 0 {
+		add("limits.maxConnections", "must not be negative, got %d", limits.MaxConnections)
+	}
+	if limits.MaxConnectionsPerIP < 0 {
+		add("limits.maxConnectionsPerIP", "must not be negative, got %d", limits.MaxConnectionsPerIP)
+	}
+	if limits.ConnectionsPerSecond < 0 {
+		add("limits.connectionsPerSecond", "must not be negative, got %v", limits.ConnectionsPerSecond)
+	}
+	if limits.ConnectionBurst < 0 {
+		add("limits.connectionBurst", "must not be negative, got %d", limits.ConnectionBurst)
+	}
+	if limits.IPv4Prefix < 0 || limits.IPv4Prefix > 32 {
+		add("limits.ipv4Prefix", "must be between 0 and 32, got %d", limits.IPv4Prefix)
+	}
+	if limits.IPv6Prefix < 0 || limits.IPv6Prefix > 128 {
+		add("limits.ipv6Prefix", "must be between 0 and 128, got %d", limits.IPv6Prefix)
+	}
+
+	bans := c.Bans
+	if bans.ConnectionsPerSecond < 0 {
+		add("bans.connectionsPerSecond", "must not be negative, got %v", bans.ConnectionsPerSecond)
+	}
+	if bans.PacketsPerSecond < 0 {
+		add("bans.packetsPerSecond", "must not be negative, got %v", bans.PacketsPerSecond)
+	}
+	if bans.FailedHandshakesPerMinute < 0 {
+		add("bans.failedHandshakesPerMinute", "must not be negative, got %d", bans.FailedHandshakesPerMinute)
+	}
+	banning := bans.ConnectionsPerSecond > 0 || bans.PacketsPerSecond > 0 || bans.FailedHandshakesPerMinute > 0
+	if bans.BanSeconds < 0 || (banning && bans.BanSeconds == 0) {
+		add("bans.banSeconds", "must be greater than 0, got %v", bans.BanSeconds)
+	}
+	if bans.MaxBanSeconds < bans.BanSeconds {
+		add("bans.maxBanSeconds", "must not be less than banSeconds (%v), got %v", bans.BanSeconds, bans.MaxBanSeconds)
+	}
+
+	bandwidth := c.Bandwidth
+	if bandwidth.ConnectionBytesPerSecond < 0 {
+		add("bandwidth.connectionBytesPerSecond", "must not be negative, got %d", bandwidth.ConnectionBytesPerSecond)
+	}
+	if bandwidth.HostBytesPerSecond < 0 {
+		add("bandwidth.hostBytesPerSecond", "must not be negative, got %d", bandwidth.HostBytesPerSecond)
+	}
+	if bandwidth.TotalBytesPerSecond < 0 {
+		add("bandwidth.totalBytesPerSecond", "must not be negative, got %d", bandwidth.TotalBytesPerSecond)
+	}
+
+	names := make(map[string]int)
+	for i, host := range c.Hosts {
+		for _, err := range host.Validate(protocol) {
+			add(fmt.Sprintf("hosts[%d].%s", i, err.Field), "%s", err.Message)
+		}
+		if first, ok := names[host.Name]; ok && host.Name != "" {
+			add(fmt.Sprintf("hosts[%d].name", i), "duplicate host name \"%s\" (already used by hosts[%d])", host.Name, first)
+			continue
+		}
+		names[host.Name] = i
+	}
+
+	if c.HealthCheckTime <= 0 {
+		add("healthCheckSeconds", "must be greater than 0, got %v", c.HealthCheckTime)
+	}
+	discovery := c.Discovery
+	if discovery.Resolver != "" {
+		if err := validateAddr("udp", discovery.Resolver, false, false); err != nil {
+			add("discovery.resolver", "%v", err)
+		}
+	}
+	if discovery.IntervalSeconds < 0 {
+		add("discovery.intervalSeconds", "must not be negative, got %v", discovery.IntervalSeconds)
+	}
+	if c.ResolveSeconds < 0 {
+		add("resolveSeconds", "must not be negative, got %v", c.ResolveSeconds)
+	}
+	if strings.HasPrefix(protocol, "udp") && c.UDPTimeout <= 0 {
+		add("UDPTimeout", "must be greater than 0, got %d", c.UDPTimeout)
+	}
+	if c.Listeners < 0 {
+		add("listeners", "must not be negative, got %d", c.Listeners)
+	}
+	if c.UDPMaxSessions < 0 {
+		add("UDPMaxSessions", "must not be negative, got %d", c.UDPMaxSessions)
+	}
+	if c.UDPFailover != "" && c.UDPFailover != FailoverReassign && c.UDPFailover != FailoverClose {
+		add("UDPFailover", "invalid policy \"%s\". supported: %s, %s", c.UDPFailover, FailoverReassign, FailoverClose)
+	}
+	if c.UDPWorkers < 0 {
+		add("UDPWorkers", "must not be negative, got %d", c.UDPWorkers)
+	}
+	if c.UDPBatchSize < 0 {
+		add("UDPBatchSize", "must not be negative, got %d", c.UDPBatchSize)
+	}
+	if c.UDPMaxDatagramSize < 0 || c.UDPMaxDatagramSize > MaxUDPDatagramSize {
+		add("UDPMaxDatagramSize", "must be between 0 and %d, got %d", MaxUDPDatagramSize, c.UDPMaxDatagramSize)
+	}
+	if c.ShutdownGrace < 0 {
+		add("shutdownGraceSeconds", "must not be negative, got %v", c.ShutdownGrace)
+	}
+	if c.ConfigBackups < 0 {
+		add("configBackups", "must not be negative, got %d", c.ConfigBackups)
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return problems
+}
+
+// Validate checks the host config for the protocol.
+// The address isn't resolved, a host which can't be resolved yet is retried by the resolver.
+// The fields of the returned errors are relative to the host.
+func (h HostConfig) Validate(protocol string) ValidationErrors {
+	problems := make(ValidationErrors, 0)
+	if h.Name == "" {
+		problems = append(problems, FieldError{"name", "must not be empty"})
+	}
+	if err := validateAddr(strings.ToLower(protocol), h.Addr, false, false); err != nil {
+		problems = append(problems, FieldError{"addr", err.Error()})
+	}
+	if !IsValidHostState(h.GetState()) {
+		problems = append(problems, FieldError{"state", fmt.Sprintf("invalid state \"%s\". supported: %s, %s, %s",
+			h.State, HostEnabled, HostDisabled, HostDraining)})
+	}
+	if h.Priority < 0 {
+		problems = append(problems, FieldError{"priority", fmt.Sprintf("must not be negative, got %d", h.Priority)})
+	}
+	if h.Weight < 0 {
+		problems = append(problems, FieldError{"weight", fmt.Sprintf("must not be negative, got %d", h.Weight)})
+	}
+	return problems
+}
+
+// validateAddr checks if the address has a valid port and can be resolved for the protocol
+func validateAddr(protocol, addr string, resolve, listen bool) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid address \"%s\": %v", addr, err)
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil || portNumber < 0 || portNumber > 65535 || (!listen && portNumber == 0) {
+		return fmt.Errorf("invalid port \"%s\"", port)
+	}
+	if !listen && host == "" {
+		return fmt.Errorf("missing host in \"%s\"", addr)
+	}
+	if !resolve {
+		return nil
+	}
+	if strings.HasPrefix(protocol, "udp") {
+		_, err = net.ResolveUDPAddr(protocol, addr)
+	} else {
+		_, err = net.ResolveTCPAddr(protocol, addr)
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't resolve \"%s\": %v", addr, err)
+	}
+	return nil
+}
+
+// unknownKeys returns an error for every key of the decoded JSON value
+// which doesn't belong to a field of the type
+func unknownKeys(path string, raw interface{}, typ reflect.Type) ValidationErrors {
+	problems := make(ValidationErrors, 0)
+	switch typ.Kind() {
+	case reflect.Struct:
+		object, ok := raw.(map[string]interface{})
+		if !ok {
+			return problems
+		}
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value := object[key]
+			field, ok := fieldByJSONName(typ, key)
+			if !ok {
+				problems = append(problems, FieldError{joinPath(path, key), "unknown key"})
+				continue
+			}
+			problems = append(problems, unknownKeys(joinPath(path, key), value, field.Type)...)
+		}
+	case reflect.Slice:
+		array, ok := raw.([]interface{})
+		if !ok {
+			return problems
+		}
+		for i, value := range array {
+			problems = append(problems, unknownKeys(fmt.Sprintf("%s[%d]", path, i), value, typ.Elem())...)
+		}
+	}
+	return problems
+}
+
+// fieldByJSONName finds the struct field the key is decoded into.
+// Like encoding/json the key is matched case insensitive.
+func fieldByJSONName(typ reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = field.Name
+		}
+		if name != "-" && strings.EqualFold(name, key) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckReportsEveryProblem(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "glass.proxy.json")
+	data := `{
+		"protocol": "sctp",
+		"addr": "0.0.0.0:99999",
+		"hosts": [
+			{"name": "a", "addr": "localhost:25580"},
+			{"name": "a", "addr": "localhost", "state": "paused"}
+		],
+		"LogConfiguration": {"logConnections": true, "logEverything": true},
+		"healthCheckSeconds": 0,
+		"limits": {"maxConnectionsPerIP": 10, "ipv4Prefix": 33},
+		"bans": {"packetsPerSecond": 1000, "banSeconds": 0, "maxBanSeconds": 60},
+		"UDPFailover": "retry",
+		"timeout": 5
+	}`
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := Check(path)
+	problems, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("expected ValidationErrors, got %v", err)
+	}
+	fields := make(map[string]bool)
+	for _, problem := range problems {
+		fields[problem.Field] = true
+	}
+	for _, field := range []string{
+		"protocol",
+		"addr",
+		"hosts[1].name",
+		"hosts[1].addr",
+		"hosts[1].state",
+		"LogConfiguration.logEverything",
+		"healthCheckSeconds",
+		"limits.ipv4Prefix",
+		"bans.banSeconds",
+		"UDPFailover",
+		"timeout",
+	} {
+		if !fields[field] {
+			t.Errorf("missing problem for %s in:\n%v", field, err)
+		}
+	}
+	if fields["hosts[0].name"] || fields["LogConfiguration.logConnections"] {
+		t.Errorf("unexpected problems:\n%v", err)
+	}
+}
+
+func TestValidateDefault(t *testing.T) {
+	conf := &Config{
+		Protocol:        "tcp",
+		Addr:            "0.0.0.0:25565",
+		Hosts:           []HostConfig{{Name: "Server-1", Addr: "localhost:25580"}},
+		HealthCheckTime: 5,
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("expected a valid config, got:\n%v", err)
+	}
+
+	conf.Protocol = "udp"
+	err := conf.Validate()
+	if err == nil || !strings.HasPrefix(err.Error(), "UDPTimeout:") {
+		t.Fatalf("expected UDPTimeout problem, got %v", err)
+	}
+}
+
+func TestValidateDoesntResolveHosts(t *testing.T) {
+	h := HostConfig{Name: "Server-1", Addr: "unresolvable.invalid:25580"}
+	if problems := h.Validate("tcp"); len(problems) != 0 {
+		t.Errorf("unresolvable host rejected: %v", problems)
+	}
+	h.Addr = "unresolvable.invalid:0"
+	if problems := h.Validate("tcp"); len(problems) != 1 || problems[0].Field != "addr" {
+		t.Errorf("expected an addr problem, got %v", problems)
+	}
+}
@@ -0,0 +1,102 @@
+package discovery
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/worldOneo/glass-proxy/config"
+)
+
+// Directory discovers the hosts listed in the JSON and YAML files of a directory
+type Directory struct {
+	Path      string
+	Protocol  string
+	signature string
+	files     map[string][]config.HostConfig
+}
+
+// NewDirectory creates a provider reading the host files in path.
+// The hosts are validated for the protocol.
+func NewDirectory(path, protocol string) *Directory {
+	return &Directory{
+		Path:     path,
+		Protocol: protocol,
+		files:    make(map[string][]config.HostConfig),
+	}
+}
+
+// Source returns the source of the discovered hosts
+func (d *Directory) Source() string {
+	return "file:" + d.Path
+}
+
+// Discover reads every host file and returns the union of their hosts.
+// A file which can't be read keeps its last hosts, invalid hosts and names described by an earlier file are skipped.
+func (d *Directory) Discover() ([]config.HostConfig, error) {
+	signature, files, err := d.scan()
+	if err != nil {
+		return nil, err
+	}
+	d.signature = signature
+	loaded := make(map[string][]config.HostConfig, len(files))
+	described := make(map[string]string)
+	hosts := make([]config.HostConfig, 0)
+	for _, file := range files {
+		fileHosts, err := config.LoadHosts(file)
+		if err != nil {
+			log.Printf("Couldn't read the hosts of %s, keeping its last hosts: %v", file, err)
+			fileHosts = d.files[file]
+		}
+		loaded[file] = fileHosts
+		for _, host := range fileHosts {
+			if problems := host.Validate(d.Protocol); len(problems) > 0 {
+				log.Printf("Skipping host %s of %s:\n%v", host.Name, file, problems)
+				continue
+			}
+			if other, ok := described[host.Name]; ok {
+				log.Printf("Skipping host %s of %s, it is already described by %s", host.Name, file, other)
+				continue
+			}
+			described[host.Name] = file
+			hosts = append(hosts, host)
+		}
+	}
+	d.files = loaded
+	return hosts, nil
+}
+
+// Changed returns if a host file was added, removed or modified since the last discovery
+func (d *Directory) Changed() bool {
+	signature, _, err := d.scan()
+	return err == nil && signature != d.signature
+}
+
+// scan lists the host files of the directory by name.
+// The signature changes with the names, sizes and modification times of the files.
+func (d *Directory) scan() (string, []string, error) {
+	entries, err := ioutil.ReadDir(d.Path)
+	if err != nil {
+		return "", nil, err
+	}
+	signature := &strings.Builder{}
+	files := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || !isHostFile(entry.Name()) {
+			continue
+		}
+		fmt.Fprintf(signature, "%s %d %d\n", entry.Name(), entry.Size(), entry.ModTime().UnixNano())
+		files = append(files, filepath.Join(d.Path, entry.Name()))
+	}
+	return signature.String(), files, nil
+}
+
+func isHostFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json", ".yaml", ".yml":
+		return true
+	}
+	return false
+}
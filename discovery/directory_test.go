@@ -0,0 +1,51 @@
+package discovery
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/worldOneo/glass-proxy/config"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDirectoryDiscovery(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.json"), `[
+		{"name": "a", "addr": "127.0.0.1:25580", "weight": 2, "tags": ["eu"]},
+		{"name": "invalid", "addr": "127.0.0.1:x"}
+	]`)
+	writeFile(t, filepath.Join(dir, "b.yaml"), "- name: b\n  addr: 127.0.0.1:25581\n- name: a\n  addr: 127.0.0.1:25582\n")
+	writeFile(t, filepath.Join(dir, ".c.json"), `[{"name": "c", "addr": "127.0.0.1:25583"}]`)
+	writeFile(t, filepath.Join(dir, "notes.txt"), "not hosts")
+
+	d := NewDirectory(dir, "tcp")
+	hosts, err := d.Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []config.HostConfig{
+		{Name: "a", Addr: "127.0.0.1:25580", Weight: 2, Tags: []string{"eu"}},
+		{Name: "b", Addr: "127.0.0.1:25581"},
+	}
+	if !reflect.DeepEqual(hosts, expected) {
+		t.Fatalf("discovered %v, expected %v", hosts, expected)
+	}
+	if d.Changed() {
+		t.Fatal("changed without a modified file")
+	}
+
+	writeFile(t, filepath.Join(dir, "b.yaml"), "- name: b\n  addr: [")
+	if !d.Changed() {
+		t.Fatal("modified file not noticed")
+	}
+	if hosts, err = d.Discover(); err != nil || !reflect.DeepEqual(hosts, expected) {
+		t.Fatalf("unreadable file didn't keep its hosts: %v, %v", hosts, err)
+	}
+}
@@ -0,0 +1,166 @@
+// Package discovery adds and removes the hosts of a service
+// from the targets found by its discovery providers.
+package discovery
+
+import (
+	"log"
+	"time"
+
+	"github.com/worldOneo/glass-proxy/config"
+	"github.com/worldOneo/glass-proxy/proxy"
+)
+
+// Timeout is the time a single discovery may take
+const Timeout = 5 * time.Second
+
+// Provider discovers the hosts of its source
+type Provider interface {
+	Source() string
+	Discover() ([]config.HostConfig, error)
+}
+
+// Watcher is a provider which notices changes of its source between two discoveries
+type Watcher interface {
+	Changed() bool
+}
+
+// Providers returns the providers configured by the discovery config.
+// The discovered hosts are validated for the protocol.
+func Providers(cnf config.DiscoveryConfig, protocol string) []Provider {
+	providers := make([]Provider, 0)
+	if cnf.SRV != "" {
+		providers = append(providers, NewSRV(cnf.SRV, cnf.Resolver))
+	}
+	if cnf.Directory != "" {
+		providers = append(providers, NewDirectory(cnf.Directory, protocol))
+	}
+	return providers
+}
+
+// Run discovers the hosts of the configured providers every interval until closing is closed.
+// Watchers are discovered as soon as they changed, the providers are recreated when the discovery config changes.
+func Run(service proxy.Service, closing <-chan struct{}) {
+	var cnf config.DiscoveryConfig
+	var providers []Provider
+	var last time.Time
+	for {
+		next := service.GetConfig()
+		if providers == nil || next.Discovery != cnf {
+			cnf, providers = next.Discovery, Providers(next.Discovery, next.Protocol)
+			last = time.Time{}
+		}
+		if time.Since(last) >= cnf.GetInterval() {
+			last = time.Now()
+			Discover(service, providers)
+		} else {
+			for _, provider := range providers {
+				if watcher, ok := provider.(Watcher); ok && watcher.Changed() {
+					discover(service, provider)
+				}
+			}
+		}
+		select {
+		case <-closing:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// Discover reconciles the hosts of every provider and removes the hosts of other sources.
+// The hosts of a provider which fails stay untouched.
+func Discover(service proxy.Service, providers []Provider) {
+	sources := make(map[string]bool)
+	for _, provider := range providers {
+		sources[provider.Source()] = true
+		discover(service, provider)
+	}
+	for _, host := range service.GetConfig().Hosts {
+		if host.Source != "" && !sources[host.Source] {
+			log.Printf("Discovery: removing host %s, %s isn't configured anymore", host.Name, host.Source)
+			service.RemHost(host.Name)
+		}
+	}
+}
+
+func discover(service proxy.Service, provider Provider) {
+	hosts, err := provider.Discover()
+	if err != nil {
+		log.Printf("Couldn't discover %s: %v", provider.Source(), err)
+		return
+	}
+	Reconcile(service, provider.Source(), hosts)
+}
+
+// Reconcile makes the hosts of the source match the discovered hosts.
+// New hosts are added, missing ones removed and changed ones replaced.
+// Hosts of other sources or from the config are never touched.
+func Reconcile(service proxy.Service, source string, discovered []config.HostConfig) {
+	current := make(map[string]config.HostConfig)
+	taken := make(map[string]bool)
+	for _, host := range service.GetConfig().Hosts {
+		if host.Source == source {
+			current[host.Name] = host
+		} else {
+			taken[host.Name] = true
+		}
+	}
+	next := make(map[string]bool)
+	for _, host := range discovered {
+		host.Source = source
+		next[host.Name] = true
+		old, ok := current[host.Name]
+		switch {
+		case taken[host.Name]:
+			log.Printf("Discovery: skipping host %s of %s, the name is already used", host.Name, source)
+		case !ok:
+			log.Printf("Discovery: adding host %s (%s)", host.Name, host.Addr)
+			service.AddHost(host)
+		case old.Addr != host.Addr || old.Priority != host.Priority || old.GetWeight() != host.GetWeight():
+			log.Printf("Discovery: replacing host %s (%s -> %s, priority %d, weight %d)",
+				host.Name, old.Addr, host.Addr, host.Priority, host.GetWeight())
+			if host.State == "" {
+				host.State = old.State
+			}
+			service.RemHost(host.Name)
+			service.AddHost(host)
+		case host.State != "" && old.GetState() != host.GetState():
+			log.Printf("Discovery: setting host %s %s", host.Name, host.GetState())
+			if err := service.SetHostState(host.Name, host.GetState()); err != nil {
+				log.Printf("Discovery: couldn't update host %s: %v", host.Name, err)
+			}
+		case !sameTags(old.Tags, host.Tags):
+			setTags(service, host.Name, host.Tags)
+		}
+	}
+	for name := range current {
+		if !next[name] {
+			log.Printf("Discovery: removing host %s", name)
+			service.RemHost(name)
+		}
+	}
+}
+
+// setTags replaces the tags of the host in the config, the running host is kept
+func setTags(service proxy.Service, name string, tags []string) {
+	service.UpdateConfig(func(cnf *config.Config) error {
+		for i := range cnf.Hosts {
+			if cnf.Hosts[i].Name == name {
+				cnf.Hosts[i].Tags = tags
+			}
+		}
+		return nil
+	})
+}
+
+func sameTags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
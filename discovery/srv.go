@@ -0,0 +1,66 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/worldOneo/glass-proxy/config"
+)
+
+// SRV discovers the targets of a DNS SRV record
+type SRV struct {
+	Name     string
+	Resolver *net.Resolver
+}
+
+// NewSRV creates a provider looking up the SRV record name at server ("ip:port").
+// The system resolver is used if server is empty.
+func NewSRV(name, server string) *SRV {
+	resolver := net.DefaultResolver
+	if server != "" {
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return &SRV{
+		Name:     name,
+		Resolver: resolver,
+	}
+}
+
+// Source returns the source of the discovered hosts
+func (s *SRV) Source() string {
+	return "srv:" + s.Name
+}
+
+// Discover looks up the SRV record and returns a host for every target.
+// A host is named and addressed by its target and port.
+func (s *SRV) Discover() ([]config.HostConfig, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+	_, records, err := s.Resolver.LookupSRV(ctx, "", "", s.Name)
+	if err != nil {
+		return nil, err
+	}
+	hosts := make([]config.HostConfig, 0, len(records))
+	for _, record := range records {
+		target := strings.TrimSuffix(record.Target, ".")
+		if target == "" {
+			continue
+		}
+		addr := net.JoinHostPort(target, strconv.Itoa(int(record.Port)))
+		hosts = append(hosts, config.HostConfig{
+			Name:     addr,
+			Addr:     addr,
+			Priority: int(record.Priority),
+			Weight:   int(record.Weight),
+		})
+	}
+	return hosts, nil
+}
@@ -0,0 +1,139 @@
+package discovery
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/worldOneo/glass-proxy/config"
+	"github.com/worldOneo/glass-proxy/proxy"
+)
+
+// srvRecord is an answer of the stub DNS server
+type srvRecord struct {
+	priority, weight, port uint16
+	target                 string
+}
+
+// startDNS answers every query with the records until the test ends
+func startDNS(t *testing.T, records []srvRecord) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < 12 {
+				continue
+			}
+			// the question ends after its name, type and class
+			end := 12
+			for end < n && buf[end] != 0 {
+				end += int(buf[end]) + 1
+			}
+			end += 5
+			if end > n {
+				continue
+			}
+			reply := append([]byte{}, buf[:end]...)
+			binary.BigEndian.PutUint16(reply[2:], 0x8180)
+			binary.BigEndian.PutUint16(reply[6:], uint16(len(records)))
+			binary.BigEndian.PutUint16(reply[8:], 0)
+			binary.BigEndian.PutUint16(reply[10:], 0)
+			for _, record := range records {
+				target := make([]byte, 0)
+				for _, label := range strings.Split(strings.TrimSuffix(record.target, "."), ".") {
+					target = append(target, byte(len(label)))
+					target = append(target, label...)
+				}
+				target = append(target, 0)
+				answer := make([]byte, 18)
+				binary.BigEndian.PutUint16(answer[0:], 0xC00C)
+				binary.BigEndian.PutUint16(answer[2:], 33)
+				binary.BigEndian.PutUint16(answer[4:], 1)
+				binary.BigEndian.PutUint32(answer[6:], 60)
+				binary.BigEndian.PutUint16(answer[10:], uint16(6+len(target)))
+				binary.BigEndian.PutUint16(answer[12:], record.priority)
+				binary.BigEndian.PutUint16(answer[14:], record.weight)
+				binary.BigEndian.PutUint16(answer[16:], record.port)
+				reply = append(reply, answer...)
+				reply = append(reply, target...)
+			}
+			conn.WriteTo(reply, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// fakeService keeps the hosts in its config
+type fakeService struct {
+	proxy.Service
+	cnf config.Config
+}
+
+func (f *fakeService) GetConfig() *config.Config {
+	return &f.cnf
+}
+
+func (f *fakeService) AddHost(host config.HostConfig) {
+	f.cnf.Hosts = append(f.cnf.Hosts, host)
+}
+
+func (f *fakeService) RemHost(name string) {
+	f.cnf.Hosts = proxy.RemoveHost(f.cnf.Hosts, name)
+}
+
+func sortedHosts(hosts []config.HostConfig) []config.HostConfig {
+	sorted := append([]config.HostConfig{}, hosts...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	return sorted
+}
+
+func TestSRVDiscovery(t *testing.T) {
+	server := startDNS(t, []srvRecord{
+		{priority: 0, weight: 3, port: 25565, target: "a.example.test."},
+		{priority: 1, weight: 0, port: 25566, target: "b.example.test."},
+	})
+	srv := NewSRV("_minecraft._tcp.example.test", server)
+	hosts, err := srv.Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []config.HostConfig{
+		{Name: "a.example.test:25565", Addr: "a.example.test:25565", Priority: 0, Weight: 3},
+		{Name: "b.example.test:25566", Addr: "b.example.test:25566", Priority: 1, Weight: 0},
+	}
+	if hosts = sortedHosts(hosts); !reflect.DeepEqual(hosts, expected) {
+		t.Fatalf("discovered %v, expected %v", hosts, expected)
+	}
+
+	static := config.HostConfig{Name: "a.example.test:25565", Addr: "10.0.0.1:25565"}
+	service := &fakeService{cnf: config.Config{Hosts: []config.HostConfig{
+		static,
+		{Name: "c.example.test:25565", Addr: "c.example.test:25565", Source: srv.Source()},
+		{Name: "b.example.test:25566", Addr: "b.example.test:25566", Priority: 2, State: config.HostDisabled, Source: srv.Source()},
+	}}}
+	Reconcile(service, srv.Source(), append(hosts, config.HostConfig{Name: "d.example.test:1", Addr: "d.example.test:1"}))
+	expected = []config.HostConfig{
+		static,
+		{Name: "b.example.test:25566", Addr: "b.example.test:25566", Priority: 1, State: config.HostDisabled, Source: srv.Source()},
+		{Name: "d.example.test:1", Addr: "d.example.test:1", Source: srv.Source()},
+	}
+	if hosts := sortedHosts(service.cnf.Hosts); !reflect.DeepEqual(hosts, sortedHosts(expected)) {
+		t.Fatalf("reconciled to %v, expected %v", hosts, expected)
+	}
+
+	Discover(service, nil)
+	if !reflect.DeepEqual(service.cnf.Hosts, []config.HostConfig{static}) {
+		t.Fatalf("hosts of unconfigured sources left: %v", service.cnf.Hosts)
+	}
+}
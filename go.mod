@@ -1,3 +1,8 @@
 module github.com/worldOneo/glass-proxy
 
 go 1.15
+
+require (
+	github.com/BurntSushi/toml v1.2.1
+	gopkg.in/yaml.v3 v3.0.1
+)
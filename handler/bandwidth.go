@@ -0,0 +1,156 @@
+package handler
+
+import (
+	"sync"
+	"time"
+)
+
+// minChunk is the smallest amount of bytes copied at once by a limited pipe
+const minChunk = 512
+
+// Bucket is a token bucket limiting the bytes per second.
+// It holds up to one second of bytes, a rate of 0 disables it.
+type Bucket struct {
+	sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket creates a new Bucket with the rate in bytes per second
+func NewBucket(rate int64) *Bucket {
+	return &Bucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// SetRate changes the rate in bytes per second, 0 disables the limit
+func (b *Bucket) SetRate(rate int64) {
+	b.Lock()
+	defer b.Unlock()
+	b.refill(time.Now())
+	b.rate = float64(rate)
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+}
+
+// Rate returns the rate in bytes per second, 0 if unlimited
+func (b *Bucket) Rate() int64 {
+	b.Lock()
+	defer b.Unlock()
+	return int64(b.rate)
+}
+
+// Wait takes n bytes from the bucket and waits until they are available
+func (b *Bucket) Wait(n int) {
+	b.Lock()
+	if b.rate <= 0 {
+		b.Unlock()
+		return
+	}
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// Allow takes n bytes from the bucket if they are available and returns if they were
+func (b *Bucket) Allow(n int) bool {
+	b.Lock()
+	defer b.Unlock()
+	if b.rate <= 0 {
+		return true
+	}
+	b.refill(time.Now())
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// Refund gives n bytes taken by Allow back to the bucket
+func (b *Bucket) Refund(n int) {
+	b.Lock()
+	defer b.Unlock()
+	if b.rate <= 0 {
+		return
+	}
+	b.tokens += float64(n)
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+}
+
+// AllowAll takes n bytes from every bucket if all of them have them available and returns if they had.
+// Buckets which already gave their bytes get them back if a later one doesn't have them.
+func AllowAll(n int, buckets ...*Bucket) bool {
+	for i, b := range buckets {
+		if !b.Allow(n) {
+			for _, taken := range buckets[:i] {
+				taken.Refund(n)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+func (b *Bucket) refill(now time.Time) {
+	if b.rate > 0 {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+	}
+	b.last = now
+}
+
+// Bandwidth limits the bytes per second in both directions of a connection
+type Bandwidth struct {
+	Upstream   *Bucket
+	Downstream *Bucket
+}
+
+// NewBandwidth creates a new Bandwidth with the rate in bytes per second for each direction
+func NewBandwidth(rate int64) *Bandwidth {
+	return &Bandwidth{
+		Upstream:   NewBucket(rate),
+		Downstream: NewBucket(rate),
+	}
+}
+
+// SetRate changes the rate in bytes per second of both directions, 0 disables the limit
+func (b *Bandwidth) SetRate(rate int64) {
+	b.Upstream.SetRate(rate)
+	b.Downstream.SetRate(rate)
+}
+
+// Rate returns the rate in bytes per second, 0 if unlimited
+func (b *Bandwidth) Rate() int64 {
+	return b.Upstream.Rate()
+}
+
+// chunkSize returns how many bytes should be copied at once to not exceed a second of the buckets
+func chunkSize(buckets []*Bucket, max int) int {
+	size := max
+	for _, b := range buckets {
+		rate := int(b.Rate())
+		if rate > 0 && rate < size {
+			size = rate
+		}
+	}
+	if size < minChunk && max >= minChunk {
+		size = minChunk
+	}
+	return size
+}
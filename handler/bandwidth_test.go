@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	b := NewBucket(1000)
+	if !b.Allow(600) || b.Allow(600) {
+		t.Fatal("bucket should hold one second of bytes")
+	}
+	b.Refund(600)
+	if !b.Allow(900) {
+		t.Fatal("refunded bytes not available")
+	}
+
+	start := time.Now()
+	b.Wait(200)
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("waited only %v for 200 bytes with 100 available at 1000 B/s", waited)
+	}
+
+	b.SetRate(0)
+	if !b.Allow(1 << 20) {
+		t.Error("a rate of 0 should be unlimited")
+	}
+	b.SetRate(100)
+	if b.Rate() != 100 || b.Allow(200) {
+		t.Error("changed rate not applied")
+	}
+}
+
+func TestAllowAllRefunds(t *testing.T) {
+	session, host, total := NewBucket(1000), NewBucket(1000), NewBucket(100)
+	for i := 0; i < 10; i++ {
+		AllowAll(500, session, host, total)
+	}
+	if !session.Allow(1000) || !host.Allow(1000) {
+		t.Error("rejected datagrams used up the earlier buckets")
+	}
+	if !AllowAll(100, NewBucket(0), total) || AllowAll(1, total) {
+		t.Error("unexpected result of the total bucket")
+	}
+}
+
+func TestChunkSize(t *testing.T) {
+	buckets := []*Bucket{NewBucket(0), NewBucket(4096), NewBucket(100)}
+	if size := chunkSize(buckets, 32*1024); size != minChunk {
+		t.Errorf("expected the minimal chunk, got %d", size)
+	}
+	if size := chunkSize(buckets[:2], 32*1024); size != 4096 {
+		t.Errorf("expected a second of the slowest bucket, got %d", size)
+	}
+}
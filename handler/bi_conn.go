@@ -3,33 +3,91 @@ package handler
 import (
 	"io"
 	"net"
+	"sync"
 )
 
+// bufferSize is the size of the buffers used to copy between connections
+const bufferSize = 32 * 1024
+
+// bufferPool holds the buffers of the pipes which can't splice
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, bufferSize)
+		return &buffer
+	},
+}
+
 // BiConn contains both connections
 type BiConn struct {
 	Conn1 net.Conn
 	Conn2 net.Conn
+	// Bandwidth limits the bytes per second, Upstream is from Conn1 to Conn2
+	Bandwidth []*Bandwidth
 }
 
 // ConnectSend Starts the Sending from conn1 to conn2
 func (b *BiConn) ConnectSend() error {
-	return pipe(b.Conn1, b.Conn2)
+	return pipe(b.Conn1, b.Conn2, b.buckets(false))
+}
+
+// pipe copies from conn2 to conn1 until conn2 is closed.
+// Two TCP connections are spliced on Linux, everything else is copied through a pooled buffer.
+func pipe(conn1 net.Conn, conn2 net.Conn, buckets []*Bucket) error {
+	dst, dstOk := conn1.(*net.TCPConn)
+	src, srcOk := conn2.(*net.TCPConn)
+	if dstOk && srcOk {
+		if spliced, err := splice(dst, src, buckets); spliced {
+			return err
+		}
+	}
+	return copyBuffered(conn1, conn2, buckets)
 }
 
-func pipe(conn1 net.Conn, conn2 net.Conn) error {
-	_, err := io.Copy(conn1, conn2)
-	return err
+func copyBuffered(conn1 net.Conn, conn2 net.Conn, buckets []*Bucket) error {
+	bufferPtr := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(bufferPtr)
+	buffer := *bufferPtr
+	for {
+		n, err := conn2.Read(buffer[:chunkSize(buckets, len(buffer))])
+		if n > 0 {
+			for _, bucket := range buckets {
+				bucket.Wait(n)
+			}
+			if _, werr := conn1.Write(buffer[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
 }
 
 // ConnectRespond Starts the sending from conn2 to conn1
 func (b *BiConn) ConnectRespond() error {
-	return pipe(b.Conn2, b.Conn1)
+	return pipe(b.Conn2, b.Conn1, b.buckets(true))
+}
+
+func (b *BiConn) buckets(upstream bool) []*Bucket {
+	buckets := make([]*Bucket, 0, len(b.Bandwidth))
+	for _, bandwidth := range b.Bandwidth {
+		if upstream {
+			buckets = append(buckets, bandwidth.Upstream)
+		} else {
+			buckets = append(buckets, bandwidth.Downstream)
+		}
+	}
+	return buckets
 }
 
-// NewBiConn creates a new BiConnection
-func NewBiConn(conn1 net.Conn, conn2 net.Conn) *BiConn {
+// NewBiConn creates a new BiConnection limited by the bandwidths
+func NewBiConn(conn1 net.Conn, conn2 net.Conn, bandwidth ...*Bandwidth) *BiConn {
 	return &BiConn{
-		Conn1: conn1,
-		Conn2: conn2,
+		Conn1:     conn1,
+		Conn2:     conn2,
+		Bandwidth: bandwidth,
 	}
 }
@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// wrappedConn hides the *net.TCPConn so the pipe has to copy
+type wrappedConn struct {
+	net.Conn
+}
+
+// connPair returns both ends of a loopback TCP connection
+func connPair(t testing.TB) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, <-accepted
+}
+
+// pipeThrough sends data through pipe from one connection pair to another and returns what arrived
+func pipeThrough(t testing.TB, data []byte, wrap bool, buckets ...*Bucket) []byte {
+	writer, src := connPair(t)
+	dst, reader := connPair(t)
+	defer src.Close()
+	defer reader.Close()
+	if wrap {
+		src, dst = &wrappedConn{src}, &wrappedConn{dst}
+	}
+
+	go func() {
+		writer.Write(data)
+		writer.Close()
+	}()
+	done := make(chan error)
+	go func() {
+		err := pipe(dst, src, buckets)
+		dst.Close()
+		done <- err
+	}()
+	received, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	return received
+}
+
+func TestPipe(t *testing.T) {
+	data := bytes.Repeat([]byte("glass-proxy"), 100000)
+	for _, wrap := range []bool{false, true} {
+		if received := pipeThrough(t, data, wrap); !bytes.Equal(received, data) {
+			t.Errorf("wrapped %v: received %d bytes, expected %d", wrap, len(received), len(data))
+		}
+		limited := pipeThrough(t, data[:4096], wrap, NewBucket(1<<20))
+		if !bytes.Equal(limited, data[:4096]) {
+			t.Errorf("wrapped %v: limited pipe received %d bytes, expected 4096", wrap, len(limited))
+		}
+	}
+}
+
+// benchmarkPipe streams b.N chunks through a single pipe
+func benchmarkPipe(b *testing.B, wrap bool) {
+	writer, src := connPair(b)
+	dst, reader := connPair(b)
+	defer reader.Close()
+	if wrap {
+		src, dst = &wrappedConn{src}, &wrappedConn{dst}
+	}
+	chunk := make([]byte, 64*1024)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			writer.Write(chunk)
+		}
+		writer.Close()
+	}()
+	go func() {
+		pipe(dst, src, nil)
+		dst.Close()
+		src.Close()
+	}()
+
+	b.SetBytes(int64(len(chunk)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkPipeSplice(b *testing.B) {
+	benchmarkPipe(b, false)
+}
+
+func BenchmarkPipeBuffered(b *testing.B) {
+	benchmarkPipe(b, true)
+}
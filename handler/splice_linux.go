@@ -0,0 +1,76 @@
+//go:build linux
+// +build linux
+
+package handler
+
+import (
+	"net"
+	"syscall"
+)
+
+// Flags of splice(2)
+const (
+	spliceMove     = 0x1
+	spliceNonblock = 0x2
+)
+
+// pipeSize is the most bytes moved through the pipe at once, the default capacity of a pipe
+const pipeSize = 64 * 1024
+
+// splice moves the data from src to dst through a pipe without copying it into user space.
+// It returns false if the connections can't be spliced.
+func splice(dst, src *net.TCPConn, buckets []*Bucket) (bool, error) {
+	srcRaw, err := src.SyscallConn()
+	if err != nil {
+		return false, nil
+	}
+	dstRaw, err := dst.SyscallConn()
+	if err != nil {
+		return false, nil
+	}
+	fds := make([]int, 2)
+	if err := syscall.Pipe2(fds, syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return false, nil
+	}
+	readPipe, writePipe := fds[0], fds[1]
+	defer syscall.Close(readPipe)
+	defer syscall.Close(writePipe)
+
+	for {
+		var n int64
+		var spliceErr error
+		err := srcRaw.Read(func(fd uintptr) bool {
+			moved, err := syscall.Splice(int(fd), nil, writePipe, nil, chunkSize(buckets, pipeSize), spliceMove|spliceNonblock)
+			n, spliceErr = int64(moved), err
+			return spliceErr != syscall.EAGAIN
+		})
+		if err == nil {
+			err = spliceErr
+		}
+		if err != nil {
+			return true, err
+		}
+		if n == 0 {
+			return true, nil
+		}
+
+		for _, bucket := range buckets {
+			bucket.Wait(int(n))
+		}
+		for n > 0 {
+			var written int64
+			err := dstRaw.Write(func(fd uintptr) bool {
+				moved, err := syscall.Splice(readPipe, nil, int(fd), nil, int(n), spliceMove|spliceNonblock)
+				written, spliceErr = int64(moved), err
+				return spliceErr != syscall.EAGAIN
+			})
+			if err == nil {
+				err = spliceErr
+			}
+			if err != nil {
+				return true, err
+			}
+			n -= written
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package handler
+
+import "net"
+
+// splice isn't supported on this system, the connections are copied instead
+func splice(dst, src *net.TCPConn, buckets []*Bucket) (bool, error) {
+	return false, nil
+}
@@ -2,28 +2,48 @@ package main
 
 import (
 	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"math/rand"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/worldOneo/glass-proxy/cmd"
 	"github.com/worldOneo/glass-proxy/cmds"
 	"github.com/worldOneo/glass-proxy/config"
+	"github.com/worldOneo/glass-proxy/discovery"
 	"github.com/worldOneo/glass-proxy/proxy"
 	"github.com/worldOneo/glass-proxy/tcp"
 	"github.com/worldOneo/glass-proxy/udp"
+	"github.com/worldOneo/glass-proxy/upgrade"
 )
 
-//
+// Defaults of the proxy
 const (
-	ConfigPath = "glass.proxy.json"
+	DefaultConfigPath   = "glass.proxy.json"
+	ConfigWatchInterval = 2 * time.Second
+)
+
+var (
+	configPath  string
+	configFlags *config.Flags
+	reloadLock  sync.Mutex
 )
 
 func main() {
+	configFlags = config.RegisterFlags(flag.CommandLine)
+	flag.StringVar(&configPath, "config", DefaultConfigPath, "The path of the config file.")
+	check := flag.Bool("check", false, "Validate the config and exit.")
+	flag.Parse()
+
+	if *check {
+		os.Exit(checkConfig())
+	}
 	cnf := loadConfig()
 	rand.Seed(time.Now().UnixNano())
 	bootProxy(cnf)
@@ -34,50 +54,185 @@ func bootProxy(cnf *config.Config) {
 	switch strings.ToLower(cnf.Protocol) {
 	case "udp", "udp4", "udp6":
 		log.Printf("Starting UDP (%s) proxy on %s...", cnf.Protocol, cnf.Addr)
-		udpService := udp.NewService(cnf)
-		go udpService.Run()
-		service = udpService
+		service = udp.NewService(cnf)
 	case "tcp", "tcp4", "tcp6":
 		log.Printf("Starting TCP (%s) proxy on %s...", cnf.Protocol, cnf.Addr)
-		tcpService := tcp.NewProxyService(cnf)
-		go tcpService.Run()
-		service = tcpService
+		service = tcp.NewProxyService(cnf)
 	default:
 		log.Fatal(errors.New("invalid protocol. supported: tcp,udp"))
 	}
 
+	proxy.ResumeDrains(service)
+
+	stopped := make(chan struct{})
+	go func() {
+		if err := service.Run(); err != nil {
+			log.Fatal(err)
+		}
+		close(stopped)
+	}()
+
 	handler := cmd.NewCommandHandler()
 	handler.Register("add", cmds.NewAddCommand(service).Handle)
 	handler.Register("rem", cmds.NewRemCommand(service).Handle)
+	handler.Register("drain", cmds.NewDrainCommand(service).Handle)
+	handler.Register("enable", cmds.NewEnableCommand(service).Handle)
+	handler.Register("disable", cmds.NewDisableCommand(service).Handle)
 	handler.Register("list", cmds.NewListCommand(service).Handle)
-	handler.Register("save", cmds.NewSaveCommand(service, ConfigPath).Handle)
+	handler.Register("sessions", cmds.NewSessionsCommand(service).Handle)
+	handler.Register("allow", cmds.NewAllowCommand(service).Handle)
+	handler.Register("deny", cmds.NewDenyCommand(service).Handle)
+	handler.Register("access", cmds.NewAccessCommand(service).Handle)
+	handler.Register("bans", cmds.NewBansCommand(service).Handle)
+	handler.Register("ban", cmds.NewBanCommand(service).Handle)
+	handler.Register("unban", cmds.NewUnbanCommand(service).Handle)
+	handler.Register("bandwidth", cmds.NewBandwidthCommand(service).Handle)
+	handler.Register("save", cmds.NewSaveCommand(func() error { return saveConfig(service) }).Handle)
+	handler.Register("rollback", cmds.NewRollbackCommand(configPath, func() { reloadConfig(service) }).Handle)
 
 	go handler.Listen()
 
-	hold()
-	if service.GetConfig().SaveConfigOnClose {
+	stopWatch := make(chan struct{})
+	go config.Watch(configPath, ConfigWatchInterval, stopWatch, func() {
+		log.Println("Config changed, reloading...")
+		reloadConfig(service)
+	})
+
+	stopDiscovery := make(chan struct{})
+	go discovery.Run(service, stopDiscovery)
+
+	upgraded := hold(service)
+	close(stopWatch)
+	close(stopDiscovery)
+	log.Println("Stoping...")
+	service.Shutdown(service.GetConfig().GetShutdownGrace())
+	<-stopped
+	if upgraded {
+		log.Println("Not saving the config, the new process took over")
+	} else if service.GetConfig().SaveConfigOnClose {
 		log.Println("Saving config...")
-		config.Create(ConfigPath, service.GetConfig())
+		if err := saveConfig(service); err != nil {
+			log.Printf("Couldn't save the config: %v", err)
+		}
 	}
-	log.Println("Stoping...")
-	return
+	log.Println("Stopped")
 }
 
-func hold() {
+// hold blocks until the proxy should stop and returns if it stops because a new process took over.
+// SIGHUP reloads the config, on an upgrade signal it only returns if the new process took over the listener.
+func hold(service proxy.Service) (upgraded bool) {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	<-c
+	signals := append([]os.Signal{os.Interrupt, syscall.SIGTERM}, reloadSignals...)
+	signals = append(signals, upgrade.Signals()...)
+	signal.Notify(c, signals...)
+	for sig := range c {
+		if isReloadSignal(sig) {
+			log.Println("Received SIGHUP, reloading config...")
+			reloadConfig(service)
+			continue
+		}
+		if !upgrade.IsSignal(sig) {
+			return false
+		}
+		if err := upgradeProxy(service); err != nil {
+			log.Printf("Couldn't upgrade: %v", err)
+			continue
+		}
+		return true
+	}
+	return false
 }
 
-func loadConfig() *config.Config {
-	cnf, cnfErr := config.Load(ConfigPath)
+func isReloadSignal(sig os.Signal) bool {
+	for _, s := range reloadSignals {
+		if s == sig {
+			return true
+		}
+	}
+	return false
+}
+
+// upgradeProxy starts the new binary and passes the listeners to it
+func upgradeProxy(service proxy.Service) error {
+	log.Println("Upgrading...")
+	listeners, err := service.ListenerFiles()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}()
+	process, err := upgrade.Start(listeners)
+	if err != nil {
+		return err
+	}
+	log.Printf("Upgraded, handed over to process %d", process.Pid)
+	return nil
+}
+
+// reloadConfig reads the config file again and applies the changes to the service
+func reloadConfig(service proxy.Service) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	next, err := readConfig()
+	if err != nil {
+		log.Printf("Couldn't reload the config:\n%v", err)
+		return
+	}
+	for _, field := range proxy.Reload(service, next) {
+		log.Printf("\"%s\" changed, restart the proxy to apply it", field)
+	}
+	log.Println("Config reloaded")
+}
+
+// checkConfig validates the config file and the overrides and prints every problem.
+// It returns the exit code of the check.
+func checkConfig() int {
+	if _, err := readConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s is invalid:\n%v\n", configPath, err)
+		return 1
+	}
+	fmt.Printf("%s is valid\n", configPath)
+	return 0
+}
 
-	if cnfErr != nil {
-		cnf = config.Default()
-		creErr := config.Create(ConfigPath, cnf)
-		if creErr != nil {
-			log.Fatal("Couldn't load the Config")
+// readConfig loads the config file and applies the environment variables and flags.
+// The resulting config is validated, the same way at startup, on reloads and by -check.
+func readConfig() (*config.Config, error) {
+	return config.Read(configPath, applyOverrides)
+}
+
+// applyOverrides applies the environment variables and flags to the config
+func applyOverrides(cnf *config.Config) error {
+	if err := cnf.ApplyEnv(os.LookupEnv); err != nil {
+		return err
+	}
+	return configFlags.Apply(cnf)
+}
+
+// saveConfig saves the config of the service.
+// The values set by environment variables or flags are saved with their values of the config file.
+func saveConfig(service proxy.Service) error {
+	cnf := service.GetConfig()
+	file, err := config.Load(configPath)
+	if err != nil {
+		file = config.Default()
+	}
+	return config.Save(configPath, cnf.WithoutOverrides(file, os.LookupEnv, configFlags), cnf.ConfigBackups)
+}
+
+// loadConfig loads the config or creates the default config if there is none
+func loadConfig() *config.Config {
+	if _, err := os.Stat(configPath); os.IsNotExist(err) {
+		if err := config.Create(configPath, config.Default()); err != nil {
+			log.Fatalf("Couldn't create the config: %v", err)
 		}
 	}
+	cnf, err := readConfig()
+	if err != nil {
+		log.Fatalf("Couldn't load the config %s:\n%v", configPath, err)
+	}
 	return cnf
 }
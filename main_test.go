@@ -31,6 +31,7 @@ func TestTCPProxy(t *testing.T) {
 	rand.Seed(time.Now().UnixNano())
 
 	proxyService := tcp.NewProxyService(&config.Config{
+		Protocol:        "tcp",
 		Addr:            "127.0.0.1:25570",
 		Hosts:           hosts,
 		HealthCheckTime: 1,
@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/worldOneo/glass-proxy/config"
+)
+
+// ConfigStore holds the config of a service as immutable snapshots.
+// Readers get the current snapshot without locking,
+// updates are applied to a copy which replaces the snapshot atomically.
+type ConfigStore struct {
+	value atomic.Value
+	lock  sync.Mutex
+}
+
+// NewConfigStore creates a new ConfigStore holding a copy of the config
+func NewConfigStore(cnf *config.Config) *ConfigStore {
+	store := &ConfigStore{}
+	store.value.Store(cnf.Clone())
+	return store
+}
+
+// Get returns the current snapshot. It must not be modified.
+func (s *ConfigStore) Get() *config.Config {
+	return s.value.Load().(*config.Config)
+}
+
+// Update applies f to a copy of the current snapshot and stores the copy.
+// The snapshot stays unchanged if f returns an error.
+func (s *ConfigStore) Update(f func(cnf *config.Config) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	next := s.Get().Clone()
+	if err := f(next); err != nil {
+		return err
+	}
+	s.value.Store(next)
+	return nil
+}
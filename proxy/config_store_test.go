@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/worldOneo/glass-proxy/config"
+)
+
+func TestConfigStoreSnapshots(t *testing.T) {
+	cnf := &config.Config{
+		Addr:  "127.0.0.1:25565",
+		Hosts: []config.HostConfig{{Name: "a", Addr: "127.0.0.1:25580", Tags: []string{"eu"}}},
+		Allow: []string{"10.0.0.0/8"},
+	}
+	store := NewConfigStore(cnf)
+	cnf.Hosts[0].Tags[0] = "us"
+	cnf.Allow[0] = "0.0.0.0/0"
+
+	snapshot := store.Get()
+	if snapshot.Hosts[0].Tags[0] != "eu" || snapshot.Allow[0] != "10.0.0.0/8" {
+		t.Fatal("the store shares the config it was created with")
+	}
+
+	err := store.Update(func(next *config.Config) error {
+		next.Addr = "127.0.0.1:25566"
+		next.Hosts[0].Tags[0] = "asia"
+		next.Hosts = append(next.Hosts, config.HostConfig{Name: "b", Addr: "127.0.0.1:25581"})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Addr != "127.0.0.1:25565" || len(snapshot.Hosts) != 1 || snapshot.Hosts[0].Tags[0] != "eu" {
+		t.Fatalf("update changed the old snapshot: %+v", snapshot)
+	}
+	if next := store.Get(); next.Addr != "127.0.0.1:25566" || len(next.Hosts) != 2 || next.Hosts[0].Tags[0] != "asia" {
+		t.Fatalf("update wasn't stored: %+v", next)
+	}
+
+	current := store.Get()
+	err = store.Update(func(next *config.Config) error {
+		next.Addr = "127.0.0.1:1"
+		return errors.New("rejected")
+	})
+	if err == nil || store.Get() != current || current.Addr != "127.0.0.1:25566" {
+		t.Fatal("failed update replaced the snapshot")
+	}
+}
@@ -1,14 +1,37 @@
 package proxy
 
-import "github.com/worldOneo/glass-proxy/config"
+import (
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"github.com/worldOneo/glass-proxy/access"
+	"github.com/worldOneo/glass-proxy/config"
+)
+
+// DrainPollInterval is the interval in which a draining host
+// is checked for its remaining connections
+const DrainPollInterval = time.Second
 
 // Service defines a service interface with the abillity to
 // Add/Get/Remove hosts and get its config
 type Service interface {
+	Run() error
+	Shutdown(time.Duration)
+	ListenerFiles() ([]*os.File, error)
 	AddHost(config.HostConfig)
 	RemHost(string)
+	SetHostState(string, string) error
+	DrainHost(string, time.Duration) error
 	GetConfig() *config.Config
+	UpdateConfig(func(*config.Config) error) error
 	ListHosts() []Host
+	Sessions() []SessionInfo
+	AccessControl() *access.Control
+	ConnectionLimiter() *access.Limiter
+	BanList() *access.Bans
+	SetBandwidth(config.BandwidthConfig)
 }
 
 // Host basic configuration for a host
@@ -17,10 +40,152 @@ type Host interface {
 	GetName() string
 	GetAddr() string
 	GetStatus() HostStatus
+	GetResolver() *Resolver
+	GetPriority() int
+	GetWeight() int
+	SetState(string)
+	CloseConnections()
 }
 
 // HostStatus enable lookups on dynamic information about a host.
 type HostStatus interface {
 	IsOnline() bool
+	GetState() string
 	GetConnectionCount() int
 }
+
+// IsAvailable returns if new connections can be assigned to a host with this status
+func IsAvailable(status HostStatus) bool {
+	return status.IsOnline() && status.GetState() == config.HostEnabled
+}
+
+// SelectHost returns the available host with the lowest priority and the least connections
+// in relation to its weight or nil if no host is available
+func SelectHost(hosts []Host) Host {
+	var selected Host
+	var connections int
+	for _, h := range hosts {
+		if !IsAvailable(h.GetStatus()) {
+			continue
+		}
+		c := h.GetStatus().GetConnectionCount()
+		if selected == nil || h.GetPriority() < selected.GetPriority() ||
+			(h.GetPriority() == selected.GetPriority() && c*selected.GetWeight() < connections*h.GetWeight()) {
+			selected, connections = h, c
+		}
+	}
+	return selected
+}
+
+// HasHost returns if a host with the given name is in the hosts config
+func HasHost(hosts []config.HostConfig, name string) bool {
+	for _, host := range hosts {
+		if host.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveHost returns the hosts config without the host with the given name
+func RemoveHost(hosts []config.HostConfig, name string) []config.HostConfig {
+	remaining := make([]config.HostConfig, 0, len(hosts))
+	for _, host := range hosts {
+		if host.Name != name {
+			remaining = append(remaining, host)
+		}
+	}
+	return remaining
+}
+
+// SetHostState updates the administrative state of the host with the given name in the hosts config
+func SetHostState(hosts []config.HostConfig, name, state string) error {
+	if !config.IsValidHostState(state) {
+		return errors.New("invalid state \"" + state + "\"")
+	}
+	for i := range hosts {
+		if hosts[i].Name == name {
+			hosts[i].State = state
+			return nil
+		}
+	}
+	return errors.New("no host named \"" + name + "\"")
+}
+
+// FindHost returns the host of the service with the given name or nil if there is none
+func FindHost(service Service, name string) Host {
+	for _, h := range service.ListHosts() {
+		if h.GetName() == name {
+			return h
+		}
+	}
+	return nil
+}
+
+// ResumeDrains drains the hosts which are draining in the config, e.g. after a restart.
+// They are removed once their connections are closed.
+func ResumeDrains(service Service) {
+	for _, host := range service.GetConfig().Hosts {
+		if host.GetState() == config.HostDraining {
+			log.Printf("Resuming to drain %s", host.Name)
+			go drain(service, host.Name)
+		}
+	}
+}
+
+func drain(service Service, name string) {
+	if err := service.DrainHost(name, 0); err != nil {
+		log.Printf("Couldn't drain %s: %v", name, err)
+	}
+}
+
+// stillDraining returns if the host is still in the service under its name and still draining.
+// Why it isn't anymore is logged.
+func stillDraining(service Service, name string, host Host) bool {
+	if FindHost(service, name) != host {
+		log.Printf("Stopped draining %s, it was removed", name)
+		return false
+	}
+	if state := host.GetStatus().GetState(); state != config.HostDraining {
+		log.Printf("Stopped draining %s, it is %s now", name, state)
+		return false
+	}
+	return true
+}
+
+// DrainHost stops new connections to the host with the given name and waits
+// until every connection of the host is closed before removing it from the service.
+// If timeout is greater than 0 the remaining connections are closed after the timeout.
+func DrainHost(service Service, name string, timeout time.Duration) error {
+	host := FindHost(service, name)
+	if host == nil {
+		return errors.New("no host named \"" + name + "\"")
+	}
+	if err := service.SetHostState(name, config.HostDraining); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	for {
+		if !stillDraining(service, name, host) {
+			return nil
+		}
+		remaining := host.GetStatus().GetConnectionCount()
+		if remaining == 0 {
+			break
+		}
+		if timeout > 0 && time.Since(start) >= timeout {
+			log.Printf("Draining %s timed out, closing %d connections", name, remaining)
+			host.CloseConnections()
+			break
+		}
+		log.Printf("Draining %s: %d connections remaining", name, remaining)
+		time.Sleep(DrainPollInterval)
+	}
+	if !stillDraining(service, name, host) {
+		return nil
+	}
+	service.RemHost(name)
+	log.Printf("Drained and removed %s", name)
+	return nil
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"log"
+
+	"github.com/worldOneo/glass-proxy/access"
+	"github.com/worldOneo/glass-proxy/config"
+)
+
+// Reload applies the changes of the next config to the running service.
+// Hosts, health check interval and logging are applied live,
+// the names of changed values which need a restart to apply are returned.
+func Reload(service Service, next *config.Config) []string {
+	current := service.GetConfig()
+	reloadHosts(service, current.Hosts, next.Hosts)
+
+	if err := service.AccessControl().Update(next.Allow, next.Deny); err != nil {
+		log.Printf("Reload: couldn't update the access lists: %v", err)
+	}
+	service.ConnectionLimiter().Update(access.Limits(next.Limits))
+	service.BanList().Update(access.BanPolicy(next.Bans))
+	service.SetBandwidth(next.Bandwidth)
+	service.UpdateConfig(func(cnf *config.Config) error {
+		cnf.Limits = next.Limits
+		cnf.Bans = next.Bans
+		cnf.Allow = append([]string{}, next.Allow...)
+		cnf.Deny = append([]string{}, next.Deny...)
+		cnf.HealthCheckTime = next.HealthCheckTime
+		cnf.ResolveSeconds = next.ResolveSeconds
+		cnf.LogConfig = next.LogConfig
+		cnf.Interfaces = append([]string{}, next.Interfaces...)
+		cnf.SaveConfigOnClose = next.SaveConfigOnClose
+		cnf.ShutdownGrace = next.ShutdownGrace
+		cnf.ConfigBackups = next.ConfigBackups
+		cnf.UDPFailover = next.UDPFailover
+		cnf.Discovery = next.Discovery
+		return nil
+	})
+
+	restart := make([]string, 0)
+	if current.Protocol != next.Protocol {
+		restart = append(restart, "protocol")
+	}
+	if current.Addr != next.Addr {
+		restart = append(restart, "addr")
+	}
+	if current.GetListeners() != next.GetListeners() {
+		restart = append(restart, "listeners")
+	}
+	if current.UDPTimeout != next.UDPTimeout {
+		restart = append(restart, "UDPTimeout")
+	}
+	if current.UDPMaxSessions != next.UDPMaxSessions {
+		restart = append(restart, "UDPMaxSessions")
+	}
+	if current.UDPWorkers != next.UDPWorkers {
+		restart = append(restart, "UDPWorkers")
+	}
+	if current.UDPBatchSize != next.UDPBatchSize {
+		restart = append(restart, "UDPBatchSize")
+	}
+	if current.UDPMaxDatagramSize != next.UDPMaxDatagramSize {
+		restart = append(restart, "UDPMaxDatagramSize")
+	}
+	return restart
+}
+
+// reloadHosts applies the changes of the configured hosts, discovered hosts are left to the discovery
+func reloadHosts(service Service, current, next []config.HostConfig) {
+	currentHosts := make(map[string]config.HostConfig)
+	for _, host := range current {
+		if host.Source == "" {
+			currentHosts[host.Name] = host
+		}
+	}
+	nextHosts := make(map[string]config.HostConfig)
+	for _, host := range next {
+		if host.Source == "" {
+			nextHosts[host.Name] = host
+		}
+	}
+
+	for name := range currentHosts {
+		if _, ok := nextHosts[name]; !ok {
+			log.Printf("Reload: removing host %s", name)
+			service.RemHost(name)
+		}
+	}
+	for _, host := range next {
+		if host.Source != "" {
+			continue
+		}
+		old, ok := currentHosts[host.Name]
+		switch {
+		case !ok:
+			log.Printf("Reload: adding host %s (%s)", host.Name, host.Addr)
+			service.AddHost(host)
+			if host.GetState() == config.HostDraining {
+				go drain(service, host.Name)
+			}
+		case old.Addr != host.Addr || old.Priority != host.Priority || old.GetWeight() != host.GetWeight():
+			log.Printf("Reload: replacing host %s (%s -> %s, priority %d, weight %d)",
+				host.Name, old.Addr, host.Addr, host.Priority, host.GetWeight())
+			service.RemHost(host.Name)
+			service.AddHost(host)
+		case old.GetState() != host.GetState() && host.GetState() == config.HostDraining:
+			log.Printf("Reload: draining host %s", host.Name)
+			go drain(service, host.Name)
+		case old.GetState() != host.GetState():
+			log.Printf("Reload: setting host %s %s", host.Name, host.GetState())
+			if err := service.SetHostState(host.Name, host.GetState()); err != nil {
+				log.Printf("Reload: couldn't update host %s: %v", host.Name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// resolveTimeout is the time a single lookup of a host name may take
+const resolveTimeout = 5 * time.Second
+
+// LookupFunc looks up the IP addresses of a host name
+type LookupFunc func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+// Resolver resolves the address of a host to its endpoints, one "ip:port" per address of its name.
+// Addresses with an IP are their only endpoint and aren't resolved.
+type Resolver struct {
+	next      uint32
+	lock      sync.RWMutex
+	name      string
+	addr      string
+	host      string
+	port      string
+	network   string
+	endpoints []string
+	lookup    LookupFunc
+	onChange  func(added, removed []string)
+}
+
+// NewResolver creates a Resolver for the address of the host with the given name without resolving it,
+// Endpoints returns the address itself until Resolve is called.
+// The network ("tcp4", "udp6", ...) restricts the addresses to IPv4 or IPv6.
+// onChange (may be nil) is called with the endpoints added and removed by later resolutions.
+func NewResolver(name, addr, network string, lookup LookupFunc, onChange func(added, removed []string)) *Resolver {
+	if lookup == nil {
+		lookup = net.DefaultResolver.LookupIPAddr
+	}
+	r := &Resolver{
+		name:     name,
+		addr:     addr,
+		network:  network,
+		lookup:   lookup,
+		onChange: onChange,
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		log.Printf("Couldn't resolve %s (%s): %v", name, addr, err)
+		return r
+	}
+	r.host, r.port = host, port
+	if net.ParseIP(strings.SplitN(host, "%", 2)[0]) != nil {
+		r.endpoints = []string{addr}
+	}
+	return r
+}
+
+// IsName returns if the address has a host name which is resolved
+func (r *Resolver) IsName() bool {
+	return r.host != "" && net.ParseIP(strings.SplitN(r.host, "%", 2)[0]) == nil
+}
+
+// Resolve looks up the host name again and updates the endpoints.
+// The endpoints stay unchanged if the lookup fails or returns no usable address.
+func (r *Resolver) Resolve() error {
+	if !r.IsName() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	addrs, err := r.lookup(ctx, r.host)
+	if err != nil {
+		log.Printf("Couldn't resolve %s (%s): %v", r.name, r.addr, err)
+		return err
+	}
+	endpoints := make([]string, 0, len(addrs))
+	seen := make(map[string]bool)
+	for _, addr := range addrs {
+		if !r.accepts(addr.IP) {
+			continue
+		}
+		ip := addr.IP.String()
+		if addr.Zone != "" {
+			ip += "%" + addr.Zone
+		}
+		endpoint := net.JoinHostPort(ip, r.port)
+		if !seen[endpoint] {
+			seen[endpoint] = true
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	if len(endpoints) == 0 {
+		log.Printf("Couldn't resolve %s (%s): no %s address", r.name, r.addr, r.network)
+		return nil
+	}
+	sort.Strings(endpoints)
+
+	r.lock.Lock()
+	added, removed := diff(r.endpoints, endpoints)
+	initial := r.endpoints == nil
+	r.endpoints = endpoints
+	r.lock.Unlock()
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+	log.Printf("%s (%s) resolved to %s", r.name, r.addr, strings.Join(endpoints, ", "))
+	if !initial && r.onChange != nil {
+		r.onChange(added, removed)
+	}
+	return nil
+}
+
+// accepts returns if the IP can be used with the network of the resolver
+func (r *Resolver) accepts(ip net.IP) bool {
+	switch {
+	case strings.HasSuffix(r.network, "4"):
+		return ip.To4() != nil
+	case strings.HasSuffix(r.network, "6"):
+		return ip.To4() == nil
+	}
+	return true
+}
+
+// diff returns the endpoints only in next (added) and only in current (removed), both sorted
+func diff(current, next []string) (added, removed []string) {
+	in := func(list []string, endpoint string) bool {
+		i := sort.SearchStrings(list, endpoint)
+		return i < len(list) && list[i] == endpoint
+	}
+	for _, endpoint := range next {
+		if !in(current, endpoint) {
+			added = append(added, endpoint)
+		}
+	}
+	for _, endpoint := range current {
+		if !in(next, endpoint) {
+			removed = append(removed, endpoint)
+		}
+	}
+	return
+}
+
+// Endpoints returns the current endpoints or the address itself if it couldn't be resolved yet
+func (r *Resolver) Endpoints() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if len(r.endpoints) == 0 {
+		return []string{r.addr}
+	}
+	return append([]string{}, r.endpoints...)
+}
+
+// Pick returns the next endpoint for which usable returns true (round robin).
+// If none is usable the next endpoint is returned anyway, usable may be nil.
+func (r *Resolver) Pick(usable func(endpoint string) bool) string {
+	endpoints := r.Endpoints()
+	start := int(atomic.AddUint32(&r.next, 1) % uint32(len(endpoints)))
+	if usable != nil {
+		for i := range endpoints {
+			if endpoint := endpoints[(start+i)%len(endpoints)]; usable(endpoint) {
+				return endpoint
+			}
+		}
+	}
+	return endpoints[start]
+}
+
+// ResolveLoop re-resolves the addresses of the hosts every resolveSeconds of the config
+// until closing is closed. It only checks the config while resolveSeconds is 0.
+func ResolveLoop(store *ConfigStore, hosts func() []Host, closing <-chan struct{}) {
+	last := time.Now()
+	for {
+		select {
+		case <-closing:
+			return
+		case <-time.After(time.Second):
+		}
+		interval := time.Duration(store.Get().ResolveSeconds * float64(time.Second))
+		if interval <= 0 || time.Since(last) < interval {
+			continue
+		}
+		last = time.Now()
+		for _, h := range hosts() {
+			h.GetResolver().Resolve()
+		}
+	}
+}
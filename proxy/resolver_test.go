@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// fakeLookup answers lookups with its addresses or its error
+type fakeLookup struct {
+	addrs []string
+	err   error
+}
+
+func (f *fakeLookup) lookup(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs := make([]net.IPAddr, 0, len(f.addrs))
+	for _, addr := range f.addrs {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(addr)})
+	}
+	return addrs, f.err
+}
+
+func TestResolver(t *testing.T) {
+	dns := &fakeLookup{addrs: []string{"10.0.0.2", "10.0.0.1", "::1", "10.0.0.1"}}
+	var added, removed []string
+	r := NewResolver("a", "backend:25565", "udp4", dns.lookup, func(a, r []string) {
+		added, removed = a, r
+	})
+	if endpoints := r.Endpoints(); !reflect.DeepEqual(endpoints, []string{"backend:25565"}) {
+		t.Fatalf("unresolved endpoints %v, expected the address", endpoints)
+	}
+	r.Resolve()
+	if added != nil || removed != nil {
+		t.Errorf("first resolution reported added %v and removed %v", added, removed)
+	}
+	if endpoints := r.Endpoints(); !reflect.DeepEqual(endpoints, []string{"10.0.0.1:25565", "10.0.0.2:25565"}) {
+		t.Fatalf("unexpected endpoints %v", endpoints)
+	}
+
+	dns.addrs = []string{"10.0.0.2", "10.0.0.3"}
+	r.Resolve()
+	if !reflect.DeepEqual(added, []string{"10.0.0.3:25565"}) || !reflect.DeepEqual(removed, []string{"10.0.0.1:25565"}) {
+		t.Errorf("added %v and removed %v", added, removed)
+	}
+
+	dns.err = errors.New("no such host")
+	r.Resolve()
+	if endpoints := r.Endpoints(); len(endpoints) != 2 {
+		t.Errorf("failed lookup changed the endpoints to %v", endpoints)
+	}
+
+	picked := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		picked[r.Pick(nil)]++
+	}
+	if picked["10.0.0.2:25565"] != 2 || picked["10.0.0.3:25565"] != 2 {
+		t.Errorf("endpoints weren't picked in turn: %v", picked)
+	}
+	for i := 0; i < 4; i++ {
+		if endpoint := r.Pick(func(endpoint string) bool { return endpoint == "10.0.0.3:25565" }); endpoint != "10.0.0.3:25565" {
+			t.Errorf("picked unusable endpoint %s", endpoint)
+		}
+	}
+
+	literal := NewResolver("b", "127.0.0.1:25565", "tcp", dns.lookup, nil)
+	if endpoints := literal.Endpoints(); !reflect.DeepEqual(endpoints, []string{"127.0.0.1:25565"}) || literal.IsName() {
+		t.Errorf("IP address resolved to %v", endpoints)
+	}
+}
@@ -0,0 +1,17 @@
+package proxy
+
+import "time"
+
+// SessionInfo is a snapshot of a client session relayed to a host
+type SessionInfo struct {
+	Client      string
+	Host        string
+	Endpoint    string
+	Upstream    string
+	Started     time.Time
+	LastActive  time.Time
+	PacketsUp   uint64
+	PacketsDown uint64
+	BytesUp     uint64
+	BytesDown   uint64
+}
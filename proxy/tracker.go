@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// ConnTracker keeps track of active connections
+// so they can be awaited or closed when the service shuts down
+type ConnTracker struct {
+	sync.Mutex
+	conns map[io.Closer]struct{}
+}
+
+// trackerPollInterval is the interval in which Wait checks for remaining connections
+const trackerPollInterval = 50 * time.Millisecond
+
+// NewConnTracker creates a new ConnTracker
+func NewConnTracker() *ConnTracker {
+	return &ConnTracker{
+		conns: make(map[io.Closer]struct{}),
+	}
+}
+
+// Add starts tracking the connection
+func (t *ConnTracker) Add(conn io.Closer) {
+	t.Lock()
+	defer t.Unlock()
+	t.conns[conn] = struct{}{}
+}
+
+// Done stops tracking the connection
+func (t *ConnTracker) Done(conn io.Closer) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.conns, conn)
+}
+
+// Count returns the amount of tracked connections
+func (t *ConnTracker) Count() int {
+	t.Lock()
+	defer t.Unlock()
+	return len(t.conns)
+}
+
+// Wait waits until every tracked connection is done or the timeout is reached.
+// It returns true if every connection is done.
+func (t *ConnTracker) Wait(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for t.Count() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(trackerPollInterval)
+	}
+	return true
+}
+
+// CloseAll closes every tracked connection
+func (t *ConnTracker) CloseAll() {
+	t.Lock()
+	defer t.Unlock()
+	for conn := range t.conns {
+		conn.Close()
+	}
+}
+
+// Shutdown waits up to the grace period for the tracked connections
+// to be done and closes the remaining ones afterwards
+func (t *ConnTracker) Shutdown(grace time.Duration) {
+	if t.Wait(grace) {
+		return
+	}
+	t.CloseAll()
+	t.Wait(grace)
+}
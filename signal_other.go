@@ -0,0 +1,10 @@
+//go:build js || plan9
+// +build js plan9
+
+package main
+
+import "os"
+
+// reloadSignals are the signals which reload the config.
+// There is no reload signal on this system, the config file is still watched.
+var reloadSignals = []os.Signal{}
@@ -0,0 +1,12 @@
+//go:build !js && !plan9
+// +build !js,!plan9
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// reloadSignals are the signals which reload the config
+var reloadSignals = []os.Signal{syscall.SIGHUP}
@@ -0,0 +1,58 @@
+package tcp
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/worldOneo/glass-proxy/config"
+	"github.com/worldOneo/glass-proxy/proxy"
+)
+
+func TestReload(t *testing.T) {
+	p := newTestService("a", "b", "d")
+	if err := p.SetHostState("a", config.HostDisabled); err != nil {
+		t.Fatal(err)
+	}
+	a, d := proxy.FindHost(p, "a"), proxy.FindHost(p, "d")
+	connect(a.(Host))
+
+	next := p.GetConfig()
+	next.Hosts = []config.HostConfig{
+		next.Hosts[0],
+		{Name: "c", Addr: "127.0.0.1:10003"},
+		{Name: "d", Addr: "127.0.0.1:10004"},
+	}
+	next.Addr = "127.0.0.1:1"
+	next.HealthCheckTime = 3
+	restart := proxy.Reload(p, next)
+
+	if !reflect.DeepEqual(restart, []string{"addr"}) {
+		t.Errorf("expected addr to need a restart, got %v", restart)
+	}
+	if h := proxy.FindHost(p, "a"); h != a {
+		t.Fatal("unchanged host was replaced")
+	}
+	if state := a.GetStatus().GetState(); state != config.HostDisabled {
+		t.Errorf("unchanged host is %s, expected it to stay disabled", state)
+	}
+	if count := a.GetStatus().GetConnectionCount(); count != 1 {
+		t.Errorf("unchanged host has %d connections, expected 1", count)
+	}
+	if proxy.FindHost(p, "b") != nil {
+		t.Error("removed host still in the service")
+	}
+	if h := proxy.FindHost(p, "c"); h == nil {
+		t.Error("added host not in the service")
+	}
+	if h := proxy.FindHost(p, "d"); h == nil || h == d || h.GetAddr() != "127.0.0.1:10004" {
+		t.Errorf("changed host wasn't replaced: %v", h)
+	}
+	cnf := p.GetConfig()
+	if cnf.HealthCheckTime != 3 || cnf.Addr != "127.0.0.1:0" {
+		t.Errorf("expected the health check time to apply and the addr to wait for a restart, got %v and %s",
+			cnf.HealthCheckTime, cnf.Addr)
+	}
+	if len(cnf.Hosts) != 3 || !proxy.HasHost(cnf.Hosts, "c") || proxy.HasHost(cnf.Hosts, "b") {
+		t.Errorf("unexpected hosts in the config %+v", cnf.Hosts)
+	}
+}
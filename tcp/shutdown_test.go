@@ -0,0 +1,123 @@
+package tcp
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/worldOneo/glass-proxy/config"
+)
+
+// startBackend starts a TCP server which keeps its connections open until the client closes them
+func startBackend(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(ioutil.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return ln.Addr().String()
+}
+
+// startProxy starts the service and returns the address it listens on
+func startProxy(t *testing.T, p *Service) string {
+	go p.Run()
+	for i := 0; i < 100; i++ {
+		p.listenerLock.Lock()
+		listeners := p.listeners
+		p.listenerLock.Unlock()
+		if len(listeners) > 0 {
+			return listeners[0].Addr().String()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("the service didn't start")
+	return ""
+}
+
+// dialProxied connects through the proxy and waits until the connection to the backend is tracked
+func dialProxied(t *testing.T, p *Service, addr string) net.Conn {
+	before := p.Connections.Count()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && p.Connections.Count() == before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if p.Connections.Count() == before {
+		t.Fatal("the connection wasn't proxied")
+	}
+	return conn
+}
+
+func newShutdownService(t *testing.T) *Service {
+	cnf := config.Default()
+	cnf.Addr = "127.0.0.1:0"
+	cnf.LogConfig = config.LogConfig{}
+	cnf.Hosts = []config.HostConfig{{Name: "a", Addr: startBackend(t)}}
+	return NewProxyService(cnf)
+}
+
+func TestShutdownClosesAfterGrace(t *testing.T) {
+	p := newShutdownService(t)
+	addr := startProxy(t, p)
+	conn := dialProxied(t, p, addr)
+	defer conn.Close()
+
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		p.Shutdown(300 * time.Millisecond)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if c, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		c.Close()
+		t.Error("new connection accepted while shutting down")
+	}
+	select {
+	case <-done:
+		t.Fatal("Shutdown didn't wait for the open connection")
+	default:
+	}
+	<-done
+	if waited := time.Since(start); waited < 300*time.Millisecond {
+		t.Errorf("Shutdown returned after %v, expected the grace of 300ms", waited)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("connection wasn't closed after the grace: %v", err)
+	}
+}
+
+func TestShutdownWaitsForConnections(t *testing.T) {
+	p := newShutdownService(t)
+	conn := dialProxied(t, p, startProxy(t, p))
+
+	done := make(chan struct{})
+	go func() {
+		p.Shutdown(10 * time.Second)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shutdown still waits after the last connection was closed")
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/worldOneo/glass-proxy/config"
+	"github.com/worldOneo/glass-proxy/handler"
 	"github.com/worldOneo/glass-proxy/proxy"
 )
 
@@ -12,38 +14,53 @@ import (
 type Host interface {
 	proxy.Host
 	HealthCheck() (bool, error)
-	AddReverseProxy(net.Conn, net.Conn)
+	Endpoint() string
+	AddReverseProxy(net.Conn, net.Conn, *handler.Bandwidth, *handler.Bandwidth)
+	SetBandwidth(host, connection int64)
 }
 
 // Host contains a config and a status about this host
 type host struct {
-	Name     string
-	Addr     string
-	Protocol string
-	Status   *HostStatus
+	Name      string
+	Addr      string
+	Protocol  string
+	Priority  int
+	Weight    int
+	Status    *HostStatus
+	Bandwidth *handler.Bandwidth
+	Resolver  *proxy.Resolver
 }
 
 // HostStatus contains *dynamic* information about a host e.g: Health
 type HostStatus struct {
 	sync.RWMutex
 	Online      bool
+	State       string
 	Connections Dict
+	Endpoints   map[string]bool
 }
 
 // Dict a map of all proxys
 type Dict map[*ReverseProxy]struct{}
 
-// NewHost returns a new Host
-func NewHost(name string, addr string, protocol string) Host {
+// NewHost returns a new Host, its address is resolved in the background
+func NewHost(hostconfig config.HostConfig, protocol string, bandwidth int64) Host {
 	host := &host{
-		Name:     name,
-		Addr:     addr,
-		Protocol: protocol,
+		Name:      hostconfig.Name,
+		Addr:      hostconfig.Addr,
+		Protocol:  protocol,
+		Priority:  hostconfig.Priority,
+		Weight:    hostconfig.GetWeight(),
+		Bandwidth: handler.NewBandwidth(bandwidth),
+		Resolver:  proxy.NewResolver(hostconfig.Name, hostconfig.Addr, protocol, nil, nil),
 		Status: &HostStatus{
 			Online:      true,
+			State:       hostconfig.GetState(),
 			Connections: make(map[*ReverseProxy]struct{}),
+			Endpoints:   make(map[string]bool),
 		},
 	}
+	go host.Resolver.Resolve()
 	return host
 }
 
@@ -54,31 +71,58 @@ func (T *host) IsRunning() bool {
 	return T.Status.Online
 }
 
-// HealthCheck let this host perform a health check and updates it health information
+// HealthCheck let this host perform a health check of each of its endpoints and updates it health information.
+// The host is online if any of its endpoints is.
 func (T *host) HealthCheck() (bool, error) {
-	conn, err := net.DialTimeout(T.Protocol, T.Addr, 2*time.Second)
-
-	defer func() {
-		if conn != nil {
-			conn.Close()
-			conn = nil
-		}
-	}()
+	endpoints := T.Resolver.Endpoints()
+	errs := make([]error, len(endpoints))
+	wg := sync.WaitGroup{}
+	for i, endpoint := range endpoints {
+		wg.Add(1)
+		go func(i int, endpoint string) {
+			defer wg.Done()
+			conn, err := net.DialTimeout(T.Protocol, endpoint, 2*time.Second)
+			if conn != nil {
+				conn.Close()
+			}
+			errs[i] = err
+		}(i, endpoint)
+	}
+	wg.Wait()
 
 	T.Status.Lock()
-	if err != nil {
-		T.Status.Online = false
-	} else {
-		T.Status.Online = true
+	defer T.Status.Unlock()
+	T.Status.Online = false
+	T.Status.Endpoints = make(map[string]bool, len(endpoints))
+	var err error
+	for i, endpoint := range endpoints {
+		T.Status.Endpoints[endpoint] = errs[i] == nil
+		if errs[i] == nil {
+			T.Status.Online = true
+		} else {
+			err = errs[i]
+		}
+	}
+	if T.Status.Online {
+		err = nil
 	}
-	T.Status.Unlock()
-
 	return T.Status.Online, err
 }
 
+// Endpoint returns the next endpoint to connect to, skipping the ones which failed their health check
+func (T *host) Endpoint() string {
+	return T.Resolver.Pick(func(endpoint string) bool {
+		T.Status.RLock()
+		defer T.Status.RUnlock()
+		online, checked := T.Status.Endpoints[endpoint]
+		return online || !checked
+	})
+}
+
 // AddReverseProxy adds a new reverse proxy and starts it based on the connections given.
-func (T *host) AddReverseProxy(conn net.Conn, serverConn net.Conn) {
-	reverseProxy := NewReverseProxy(conn, serverConn)
+// The proxy is limited by its own bandwidth, the bandwidth of this host and the total bandwidth.
+func (T *host) AddReverseProxy(conn net.Conn, serverConn net.Conn, bandwidth, total *handler.Bandwidth) {
+	reverseProxy := NewReverseProxy(conn, serverConn, bandwidth, T.Bandwidth, total)
 
 	T.Status.Lock()
 	T.Status.Connections[reverseProxy] = struct{}{}
@@ -91,6 +135,32 @@ func (T *host) AddReverseProxy(conn net.Conn, serverConn net.Conn) {
 	reverseProxy.pipeBothAndClose()
 }
 
+// SetState sets the administrative state of this host
+func (T *host) SetState(state string) {
+	T.Status.Lock()
+	defer T.Status.Unlock()
+	T.Status.State = state
+}
+
+// CloseConnections closes every connection held by this host
+func (T *host) CloseConnections() {
+	T.Status.RLock()
+	defer T.Status.RUnlock()
+	for reverseProxy := range T.Status.Connections {
+		reverseProxy.Close()
+	}
+}
+
+// SetBandwidth changes the bandwidth limit of this host and of each of its connections
+func (T *host) SetBandwidth(host, connection int64) {
+	T.Bandwidth.SetRate(host)
+	T.Status.RLock()
+	defer T.Status.RUnlock()
+	for reverseProxy := range T.Status.Connections {
+		reverseProxy.bandwidth.SetRate(connection)
+	}
+}
+
 // GetConnectionCount returns the amount of connections held by this Host
 func (T *HostStatus) GetConnectionCount() int {
 	T.RLock()
@@ -110,6 +180,13 @@ func (T *HostStatus) IsOnline() bool {
 	return T.Online
 }
 
+// GetState returns the administrative state of the host
+func (T *HostStatus) GetState() string {
+	T.RLock()
+	defer T.RUnlock()
+	return T.State
+}
+
 // GetName returns the name of the host
 func (T *host) GetName() string {
 	return T.Name
@@ -123,3 +200,18 @@ func (T *host) GetAddr() string {
 func (T *host) GetStatus() proxy.HostStatus {
 	return T.Status
 }
+
+// GetResolver returns the resolver of the address of the host
+func (T *host) GetResolver() *proxy.Resolver {
+	return T.Resolver
+}
+
+// GetPriority returns the priority of the host, lower is preferred
+func (T *host) GetPriority() int {
+	return T.Priority
+}
+
+// GetWeight returns the weight of the host among hosts of the same priority
+func (T *host) GetWeight() int {
+	return T.Weight
+}
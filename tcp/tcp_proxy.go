@@ -2,16 +2,20 @@ package tcp
 
 import (
 	"errors"
+	"fmt"
 	"log"
-	"math"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/worldOneo/glass-proxy/access"
 	"github.com/worldOneo/glass-proxy/cmd"
 	"github.com/worldOneo/glass-proxy/config"
 	"github.com/worldOneo/glass-proxy/handler"
 	"github.com/worldOneo/glass-proxy/proxy"
+	"github.com/worldOneo/glass-proxy/upgrade"
 )
 
 // Service with everything we need
@@ -19,13 +23,23 @@ type Service struct {
 	proxy.Service
 	Hosts          []Host
 	HostsLock      *sync.RWMutex
-	Config         *config.Config
+	Config         *proxy.ConfigStore
 	CommandHandler *cmd.CommandHandler
+	Connections    *proxy.ConnTracker
+	Access         *access.Control
+	Limiter        *access.Limiter
+	Bans           *access.Bans
+	Bandwidth      *handler.Bandwidth
+	listeners      []net.Listener
+	listenerLock   sync.Mutex
+	closing        chan struct{}
+	closeOnce      sync.Once
 }
 
 // ReverseProxy reverse tcp proxy
 type ReverseProxy struct {
-	biConn *handler.BiConn
+	biConn    *handler.BiConn
+	bandwidth *handler.Bandwidth
 }
 
 // Pipe establisches a connection between both ends
@@ -36,23 +50,53 @@ func (r *ReverseProxy) Pipe() {
 func (r *ReverseProxy) pipeBothAndClose() {
 	go r.biConn.ConnectSend()
 	r.biConn.ConnectRespond()
+	r.Close()
+}
+
+// Close closes both ends of the reverse proxy
+func (r *ReverseProxy) Close() {
 	r.biConn.Conn1.Close()
 	r.biConn.Conn2.Close()
 }
 
-// NewReverseProxy creates a new reverse tcp Proxy
-func NewReverseProxy(conn1 net.Conn, conn2 net.Conn) *ReverseProxy {
+// handshakeConn remembers if anything was read from the connection
+type handshakeConn struct {
+	net.Conn
+	read int32
+}
+
+func (h *handshakeConn) Read(b []byte) (int, error) {
+	n, err := h.Conn.Read(b)
+	if n > 0 {
+		atomic.StoreInt32(&h.read, 1)
+	}
+	return n, err
+}
+
+// NewReverseProxy creates a new reverse tcp Proxy limited by its own bandwidth
+// and the bandwidths shared with other proxies
+func NewReverseProxy(conn1 net.Conn, conn2 net.Conn, bandwidth *handler.Bandwidth, shared ...*handler.Bandwidth) *ReverseProxy {
 	return &ReverseProxy{
-		biConn: handler.NewBiConn(conn1, conn2),
+		biConn:    handler.NewBiConn(conn1, conn2, append([]*handler.Bandwidth{bandwidth}, shared...)...),
+		bandwidth: bandwidth,
 	}
 }
 
 // NewProxyService creates a new Proxy Service and starts the cleaner
 func NewProxyService(cnf *config.Config) *Service {
 	proxy := &Service{
-		Config:         cnf,
+		Config:         proxy.NewConfigStore(cnf),
 		CommandHandler: cmd.NewCommandHandler(),
 		HostsLock:      &sync.RWMutex{},
+		Connections:    proxy.NewConnTracker(),
+		Access:         &access.Control{},
+		Limiter:        access.NewLimiter(access.Limits(cnf.Limits)),
+		Bans:           access.NewBans(access.BanPolicy(cnf.Bans)),
+		Bandwidth:      handler.NewBandwidth(cnf.Bandwidth.TotalBytesPerSecond),
+		closing:        make(chan struct{}),
+	}
+	if err := proxy.Access.Update(cnf.Allow, cnf.Deny); err != nil {
+		log.Printf("Invalid access lists: %v", err)
 	}
 	proxy.LoadHosts()
 
@@ -63,55 +107,90 @@ func NewProxyService(cnf *config.Config) *Service {
 func (p *Service) LoadHosts() {
 	p.HostsLock.Lock()
 	defer p.HostsLock.Unlock()
+	cnf := p.Config.Get()
 	hosts := make([]Host, 0)
-	for _, host := range p.Config.Hosts {
-		newHost := NewHost(host.Name, host.Addr, p.Config.Protocol)
+	for _, host := range cnf.Hosts {
+		newHost := NewHost(host, cnf.Protocol, cnf.Bandwidth.HostBytesPerSecond)
 		hosts = append(hosts, newHost)
 	}
 	p.Hosts = hosts
 }
 
-// AddHost adds a host and adds it to the config
+// AddHost adds a host and adds it to the config.
+// The already existing hosts and their connections stay untouched.
 func (p *Service) AddHost(host config.HostConfig) {
 	p.HostsLock.Lock()
 	defer p.HostsLock.Unlock()
-	p.Config.Hosts = append(p.Config.Hosts, host)
-	p.LoadHosts()
+	err := p.Config.Update(func(cnf *config.Config) error {
+		if proxy.HasHost(cnf.Hosts, host.Name) {
+			return errors.New("host " + host.Name + " already exists")
+		}
+		cnf.Hosts = append(cnf.Hosts, host)
+		return nil
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	cnf := p.Config.Get()
+	p.Hosts = append(p.Hosts, NewHost(host, cnf.Protocol, cnf.Bandwidth.HostBytesPerSecond))
 }
 
-// RemHost removes a host
+// RemHost removes a host.
+// Its opened connections stay until they are closed.
 func (p *Service) RemHost(name string) {
 	p.HostsLock.Lock()
 	defer p.HostsLock.Unlock()
-	hosts := make([]config.HostConfig, 0)
-	for _, host := range p.Config.Hosts {
-		if host.Name != name {
-			hosts = append(hosts, host)
+	p.Config.Update(func(cnf *config.Config) error {
+		cnf.Hosts = proxy.RemoveHost(cnf.Hosts, name)
+		return nil
+	})
+	hosts := make([]Host, 0, len(p.Hosts))
+	for _, h := range p.Hosts {
+		if h.GetName() != name {
+			hosts = append(hosts, h)
 		}
 	}
-	p.Config.Hosts = hosts
-	p.LoadHosts()
+	p.Hosts = hosts
 }
 
-// GetHost gets a random running host or nil if no host is available
+// SetHostState sets the administrative state of the host and updates the config
+func (p *Service) SetHostState(name, state string) error {
+	p.HostsLock.Lock()
+	defer p.HostsLock.Unlock()
+	err := p.Config.Update(func(cnf *config.Config) error {
+		return proxy.SetHostState(cnf.Hosts, name, state)
+	})
+	if err != nil {
+		return err
+	}
+	for _, h := range p.Hosts {
+		if h.GetName() == name {
+			h.SetState(state)
+		}
+	}
+	return nil
+}
+
+// DrainHost stops new connections to the host and removes it once its connections are closed.
+// Remaining connections are closed after the timeout if it is greater than 0.
+func (p *Service) DrainHost(name string, timeout time.Duration) error {
+	return proxy.DrainHost(p, name, timeout)
+}
+
+// GetHost gets the available host with the lowest priority and the least connections per weight
+// or nil if no host is available
 func (p *Service) GetHost() Host {
 	p.HostsLock.RLock()
 	defer p.HostsLock.RUnlock()
-
-	index := -1
-	min := math.MaxInt32
-	c := 0
+	hosts := make([]proxy.Host, len(p.Hosts))
 	for i, h := range p.Hosts {
-		c = h.GetStatus().GetConnectionCount()
-		if c < min && h.GetStatus().IsOnline() {
-			min = c
-			index = i
-		}
+		hosts[i] = h
 	}
-	if index == -1 {
-		return nil
+	if selected := proxy.SelectHost(hosts); selected != nil {
+		return selected.(Host)
 	}
-	return p.Hosts[index]
+	return nil
 }
 
 // DialToHost dials a connection or returns error.
@@ -121,14 +200,15 @@ func (p *Service) DialToHost(protocol string, client net.Conn) (Host, net.Conn,
 	if host == nil {
 		return nil, nil, errors.New("No Healthy host available")
 	}
-	addr := host.GetAddr()
-	if p.Config.Interfaces == nil || len(p.Config.Interfaces) == 0 {
+	addr := host.Endpoint()
+	interfaces := p.Config.Get().Interfaces
+	if len(interfaces) == 0 {
 		conn, err := net.Dial(protocol, addr)
 		return host, conn, err
 	}
 
 	err := errors.New("Couldn't dial a connection over any of the given interfaces")
-	for _, i := range p.Config.Interfaces {
+	for _, i := range interfaces {
 		ief, err := net.InterfaceByName(i)
 		if err != nil {
 			continue
@@ -153,14 +233,17 @@ func (p *Service) DialToHost(protocol string, client net.Conn) (Host, net.Conn,
 }
 
 // HealthCheck checks the health of every given server and updates their status
+// until the service is shut down. The hosts aren't locked while they are checked.
 func (p *Service) HealthCheck() {
 	for {
-		p.HostsLock.RLock()
-		for _, h := range p.Hosts {
-			h.HealthCheck()
+		for _, h := range p.ListHosts() {
+			h.(Host).HealthCheck()
+		}
+		select {
+		case <-p.closing:
+			return
+		case <-time.After(time.Duration(p.Config.Get().HealthCheckTime * float64(time.Second))):
 		}
-		p.HostsLock.RUnlock()
-		time.Sleep(time.Second * time.Duration(p.Config.HealthCheckTime))
 	}
 }
 
@@ -181,10 +264,15 @@ func createDialer(protocol, addr string) (*net.Dialer, error) {
 	return &d, resError
 }
 
+// Handle bridges the client connection to a host
 func (p *Service) Handle(conn net.Conn) {
-	host, remote, err := p.DialToHost(p.Config.Protocol, conn)
+	p.Connections.Add(conn)
+	defer p.Connections.Done(conn)
+	cnf := p.Config.Get()
+	host, remote, err := p.DialToHost(cnf.Protocol, conn)
 
 	if err != nil {
+		conn.Close()
 		if host == nil {
 			log.Printf("Couldn't connect to any host \"%v\"", err)
 			return
@@ -194,7 +282,7 @@ func (p *Service) Handle(conn net.Conn) {
 	}
 
 	defer func() {
-		if p.Config.LogConfig.LogDisconnect {
+		if p.Config.Get().LogConfig.LogDisconnect {
 			log.Printf("%s Disconnected", conn.RemoteAddr())
 		}
 		conn.Close()
@@ -205,11 +293,20 @@ func (p *Service) Handle(conn net.Conn) {
 		return
 	}
 
-	if p.Config.LogConfig.LogConnections {
+	if cnf.LogConfig.LogConnections {
 		log.Printf("%s Connected to %s (%s) over %s", conn.RemoteAddr(), host.GetName(), host.GetAddr(), remote.LocalAddr())
 	}
 
-	host.AddReverseProxy(conn, remote)
+	bandwidth := handler.NewBandwidth(cnf.Bandwidth.ConnectionBytesPerSecond)
+	if !p.Bans.CountsFailedHandshakes() {
+		host.AddReverseProxy(conn, remote, bandwidth, p.Bandwidth)
+		return
+	}
+	client := &handshakeConn{Conn: conn}
+	host.AddReverseProxy(client, remote, bandwidth, p.Bandwidth)
+	if atomic.LoadInt32(&client.read) == 0 {
+		p.Bans.FailedHandshake(conn.RemoteAddr())
+	}
 }
 
 // ListHosts gets all hosts useable for this service
@@ -223,22 +320,166 @@ func (p *Service) ListHosts() []proxy.Host {
 	return castedHosts
 }
 
+// Sessions returns nil, TCP connections aren't kept as sessions
+func (p *Service) Sessions() []proxy.SessionInfo {
+	return nil
+}
+
+// GetConfig returns a copy of the config.
+// changes to the config returned don't apply to the service, use UpdateConfig instead.
 func (p *Service) GetConfig() *config.Config {
-	return p.Config
+	return p.Config.Get().Clone()
 }
 
-func (p *Service) Run() {
-	go p.HealthCheck()
-	ln, err := net.Listen(p.Config.Protocol, p.Config.Addr)
+// AccessControl returns the allow and deny lists of the clients
+func (p *Service) AccessControl() *access.Control {
+	return p.Access
+}
+
+// ConnectionLimiter returns the limiter of the client connections
+func (p *Service) ConnectionLimiter() *access.Limiter {
+	return p.Limiter
+}
+
+// BanList returns the banned clients
+func (p *Service) BanList() *access.Bans {
+	return p.Bans
+}
+
+// SetBandwidth changes the bandwidth limits of the service, its hosts and their connections
+func (p *Service) SetBandwidth(bandwidth config.BandwidthConfig) {
+	p.Config.Update(func(cnf *config.Config) error {
+		cnf.Bandwidth = bandwidth
+		return nil
+	})
+	p.Bandwidth.SetRate(bandwidth.TotalBytesPerSecond)
+	p.HostsLock.RLock()
+	defer p.HostsLock.RUnlock()
+	for _, h := range p.Hosts {
+		h.SetBandwidth(bandwidth.HostBytesPerSecond, bandwidth.ConnectionBytesPerSecond)
+	}
+}
+
+// UpdateConfig applies f to a copy of the config which replaces the config if f doesn't fail
+func (p *Service) UpdateConfig(f func(*config.Config) error) error {
+	return p.Config.Update(f)
+}
+
+// Run starts the TCP proxy and accepts connections until the service is shut down
+func (p *Service) Run() error {
+	cnf := p.Config.Get()
+	listeners, err := upgrade.Listen(cnf.Protocol, cnf.Addr, cnf.GetListeners())
 	if err != nil {
-		log.Fatalf("Couldn't start the server: %v", err)
+		return fmt.Errorf("couldn't start the server: %v", err)
 	}
-	log.Printf("Listening on %s", p.Config.Addr)
+	p.listenerLock.Lock()
+	select {
+	case <-p.closing:
+		p.listenerLock.Unlock()
+		for _, ln := range listeners {
+			ln.Close()
+		}
+		return nil
+	default:
+	}
+	p.listeners = listeners
+	p.listenerLock.Unlock()
+
+	go p.HealthCheck()
+	go proxy.ResolveLoop(p.Config, p.ListHosts, p.closing)
+	log.Printf("Listening on %s (%d listeners)", cnf.Addr, len(listeners))
+	upgrade.Ready()
+	var wg sync.WaitGroup
+	for _, ln := range listeners {
+		wg.Add(1)
+		go func(ln net.Listener) {
+			defer wg.Done()
+			p.accept(ln)
+		}(ln)
+	}
+	wg.Wait()
+	return nil
+}
+
+// accept accepts connections on ln until the service is shut down
+func (p *Service) accept(ln net.Listener) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			select {
+			case <-p.closing:
+				return
+			default:
+				continue
+			}
+		}
+		if p.Bans.Banned(conn.RemoteAddr()) || p.Bans.Connection(conn.RemoteAddr()) {
+			conn.Close()
 			continue
 		}
-		go p.Handle(conn)
+		if !p.Access.Allowed(conn.RemoteAddr()) {
+			if p.Config.Get().LogConfig.LogConnections {
+				log.Printf("%s Rejected by the access lists", conn.RemoteAddr())
+			}
+			conn.Close()
+			continue
+		}
+		release, err := p.Limiter.Acquire(conn.RemoteAddr())
+		if err != nil {
+			if p.Config.Get().LogConfig.LogConnections {
+				log.Printf("%s Rejected: %v", conn.RemoteAddr(), err)
+			}
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer release()
+			p.Handle(conn)
+		}()
+	}
+}
+
+// ListenerFiles returns duplicates of the listening sockets to pass them to another process
+func (p *Service) ListenerFiles() ([]*os.File, error) {
+	p.listenerLock.Lock()
+	defer p.listenerLock.Unlock()
+	if len(p.listeners) == 0 {
+		return nil, errors.New("the service isn't listening")
 	}
+	files := make([]*os.File, 0, len(p.listeners))
+	for _, ln := range p.listeners {
+		tcpListener, ok := ln.(*net.TCPListener)
+		if !ok {
+			return nil, closeFiles(files, errors.New("the service isn't listening on TCP"))
+		}
+		file, err := tcpListener.File()
+		if err != nil {
+			return nil, closeFiles(files, err)
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// closeFiles closes the files and returns err
+func closeFiles(files []*os.File, err error) error {
+	for _, file := range files {
+		file.Close()
+	}
+	return err
+}
+
+// Shutdown stops accepting new connections and waits up to grace
+// for the active connections to close before closing them
+func (p *Service) Shutdown(grace time.Duration) {
+	p.closeOnce.Do(func() {
+		p.listenerLock.Lock()
+		close(p.closing)
+		for _, ln := range p.listeners {
+			ln.Close()
+		}
+		p.listenerLock.Unlock()
+	})
+	log.Printf("Waiting for %d connections to close...", p.Connections.Count())
+	p.Connections.Shutdown(grace)
 }
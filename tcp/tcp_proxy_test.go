@@ -0,0 +1,214 @@
+package tcp
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/worldOneo/glass-proxy/config"
+	"github.com/worldOneo/glass-proxy/handler"
+	"github.com/worldOneo/glass-proxy/proxy"
+)
+
+func newTestService(names ...string) *Service {
+	hosts := make([]config.HostConfig, 0, len(names))
+	for i, name := range names {
+		hosts = append(hosts, config.HostConfig{Name: name, Addr: fmt.Sprintf("127.0.0.1:%d", 10000+i)})
+	}
+	return NewProxyService(&config.Config{Protocol: "tcp", Addr: "127.0.0.1:0", Hosts: hosts, HealthCheckTime: 1})
+}
+
+// connect adds a connection to the host which stays open until it is closed by the host
+func connect(h Host) {
+	client, _ := net.Pipe()
+	server, _ := net.Pipe()
+	started := make(chan struct{})
+	go func() {
+		close(started)
+		h.AddReverseProxy(client, server, handler.NewBandwidth(0), handler.NewBandwidth(0))
+	}()
+	<-started
+	for h.GetStatus().GetConnectionCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDrainHost(t *testing.T) {
+	p := newTestService("a", "b")
+	connect(p.Hosts[0])
+
+	done := make(chan error)
+	go func() { done <- p.DrainHost("a", 100*time.Millisecond) }()
+	time.Sleep(10 * time.Millisecond)
+	if state := p.Hosts[0].GetStatus().GetState(); state != config.HostDraining {
+		t.Fatalf("draining host is %s", state)
+	}
+	if h := p.GetHost(); h == nil || h.GetName() != "b" {
+		t.Fatalf("draining host still selected: %v", h)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if proxy.FindHost(p, "a") != nil || proxy.HasHost(p.GetConfig().Hosts, "a") {
+		t.Fatal("drained host wasn't removed")
+	}
+	if err := p.DrainHost("a", 0); err == nil {
+		t.Fatal("drained an unknown host")
+	}
+}
+
+func TestEnableStopsDrain(t *testing.T) {
+	p := newTestService("a", "b")
+	connect(p.Hosts[0])
+
+	done := make(chan error)
+	go func() { done <- p.DrainHost("a", 100*time.Millisecond) }()
+	time.Sleep(10 * time.Millisecond)
+	if err := p.SetHostState("a", config.HostEnabled); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	h := proxy.FindHost(p, "a")
+	if h == nil {
+		t.Fatal("enabled host was removed by the drain")
+	}
+	if count := h.GetStatus().GetConnectionCount(); count != 1 {
+		t.Errorf("enabled host has %d connections, expected 1", count)
+	}
+}
+
+func TestDrainKeepsReaddedHost(t *testing.T) {
+	p := newTestService("a", "b")
+	connect(p.Hosts[0])
+
+	done := make(chan error)
+	go func() { done <- p.DrainHost("a", 0) }()
+	time.Sleep(10 * time.Millisecond)
+	p.RemHost("a")
+	p.AddHost(config.HostConfig{Name: "a", Addr: "127.0.0.1:10002"})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if h := proxy.FindHost(p, "a"); h == nil || h.GetAddr() != "127.0.0.1:10002" {
+		t.Fatalf("drain removed the host added again: %v", h)
+	}
+}
+
+func TestHostState(t *testing.T) {
+	p := newTestService("a", "b")
+	if err := p.SetHostState("a", config.HostDisabled); err != nil {
+		t.Fatal(err)
+	}
+	if state := p.GetConfig().Hosts[0].GetState(); state != config.HostDisabled {
+		t.Fatalf("config state is %s", state)
+	}
+	if h := p.GetHost(); h == nil || h.GetName() != "b" {
+		t.Fatalf("disabled host selected: %v", h)
+	}
+	if err := p.SetHostState("b", config.HostDisabled); err != nil {
+		t.Fatal(err)
+	}
+	if h := p.GetHost(); h != nil {
+		t.Fatalf("selected %s without enabled hosts", h.GetName())
+	}
+
+	if err := p.SetHostState("a", config.HostEnabled); err != nil {
+		t.Fatal(err)
+	}
+	if h := p.GetHost(); h == nil || h.GetName() != "a" {
+		t.Fatalf("enabled host not selected: %v", h)
+	}
+	if err := p.SetHostState("a", "paused"); err == nil {
+		t.Fatal("set an invalid state")
+	}
+	if err := p.SetHostState("c", config.HostEnabled); err == nil {
+		t.Fatal("set the state of an unknown host")
+	}
+	if state := p.Hosts[0].GetStatus().GetState(); state != config.HostEnabled {
+		t.Fatalf("failed update changed the state to %s", state)
+	}
+}
+
+func TestResumeDrains(t *testing.T) {
+	p := newTestService("a", "b")
+	p.UpdateConfig(func(cnf *config.Config) error {
+		cnf.Hosts[0].State = config.HostDraining
+		return nil
+	})
+	proxy.ResumeDrains(p)
+	for start := time.Now(); proxy.FindHost(p, "a") != nil; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("draining host wasn't removed")
+		}
+	}
+	if proxy.FindHost(p, "b") == nil {
+		t.Fatal("enabled host was removed")
+	}
+}
+
+func TestAddRemHostKeepsHosts(t *testing.T) {
+	p := newTestService("a", "b")
+	a := p.Hosts[0]
+	connect(a)
+	if err := p.SetHostState("a", config.HostDisabled); err != nil {
+		t.Fatal(err)
+	}
+
+	p.AddHost(config.HostConfig{Name: "c", Addr: "127.0.0.1:10002"})
+	p.AddHost(config.HostConfig{Name: "a", Addr: "127.0.0.1:10003"})
+	p.RemHost("b")
+	if len(p.Hosts) != 2 || p.Hosts[0] != a || p.Hosts[1].GetName() != "c" {
+		t.Fatalf("unexpected hosts %v", p.ListHosts())
+	}
+	if a.GetStatus().GetState() != config.HostDisabled || a.GetStatus().GetConnectionCount() != 1 {
+		t.Fatal("existing host lost its state or connections")
+	}
+	hosts := p.GetConfig().Hosts
+	if len(hosts) != 2 || hosts[0].Name != "a" || hosts[0].Addr != "127.0.0.1:10000" || hosts[1].Name != "c" {
+		t.Fatalf("unexpected config hosts %v", hosts)
+	}
+	a.CloseConnections()
+}
+
+// slowHost is a host whose health check blocks until it is released
+type slowHost struct {
+	Host
+	checking chan struct{}
+	release  chan struct{}
+}
+
+func (h *slowHost) HealthCheck() (bool, error) {
+	select {
+	case h.checking <- struct{}{}:
+	default:
+	}
+	<-h.release
+	return true, nil
+}
+
+func TestHealthCheckDoesntLockHosts(t *testing.T) {
+	p := newTestService("a")
+	slow := &slowHost{Host: p.Hosts[0], checking: make(chan struct{}, 1), release: make(chan struct{})}
+	p.Hosts[0] = slow
+	go p.HealthCheck()
+	defer p.Shutdown(0)
+	<-slow.checking
+	defer close(slow.release)
+
+	added := make(chan struct{})
+	go func() {
+		p.AddHost(config.HostConfig{Name: "b", Addr: "127.0.0.1:10001"})
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatal("adding a host waited for the health check")
+	}
+	if h := p.GetHost(); h == nil {
+		t.Fatal("no host selected during the health check")
+	}
+}
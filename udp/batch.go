@@ -0,0 +1,52 @@
+package udp
+
+import (
+	"net"
+)
+
+// message is a datagram read or written as part of a batch
+type message struct {
+	Buffer []byte
+	N      int
+	Addr   *net.UDPAddr
+	// Truncated is set if the datagram read didn't fit into the buffer
+	Truncated bool
+}
+
+// batchConn reads and writes the datagrams of a UDP socket in batches
+type batchConn interface {
+	// ReadBatch reads at least one datagram into the buffers of msgs and returns how many were read
+	ReadBatch(msgs []message) (int, error)
+	// WriteBatch writes the first N bytes of every buffer in msgs to its address
+	WriteBatch(msgs []message) error
+}
+
+// singleConn reads and writes one datagram at a time on systems without batch syscalls
+type singleConn struct {
+	conn *net.UDPConn
+}
+
+func (s *singleConn) ReadBatch(msgs []message) (int, error) {
+	n, addr, truncated, err := readDatagram(s.conn, msgs[0].Buffer)
+	if err != nil {
+		return 0, err
+	}
+	msgs[0].N, msgs[0].Addr, msgs[0].Truncated = n, addr, truncated
+	return 1, nil
+}
+
+func (s *singleConn) WriteBatch(msgs []message) error {
+	var lastErr error
+	for _, msg := range msgs {
+		if _, err := s.conn.WriteToUDP(msg.Buffer[:msg.N], msg.Addr); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// readDatagram reads a datagram and reports if it was larger than the buffer
+func readDatagram(conn *net.UDPConn, buffer []byte) (int, *net.UDPAddr, bool, error) {
+	n, _, flags, addr, err := conn.ReadMsgUDP(buffer, nil)
+	return n, addr, flags&msgTrunc != 0, err
+}
@@ -0,0 +1,200 @@
+//go:build linux
+// +build linux
+
+package udp
+
+import (
+	"net"
+	"runtime"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// mmsghdr is struct mmsghdr of recvmmsg(2) and sendmmsg(2)
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+// mmsgConn reads and writes batches with recvmmsg(2) and sendmmsg(2)
+type mmsgConn struct {
+	raw    syscall.RawConn
+	family int
+	read   mmsgBuffers
+	write  mmsgBuffers
+}
+
+// mmsgBuffers are the headers of a batch, reused for every call
+type mmsgBuffers struct {
+	hdrs  []mmsghdr
+	iovs  []syscall.Iovec
+	names []syscall.RawSockaddrAny
+}
+
+func newMmsgBuffers(size int) mmsgBuffers {
+	return mmsgBuffers{
+		hdrs:  make([]mmsghdr, size),
+		iovs:  make([]syscall.Iovec, size),
+		names: make([]syscall.RawSockaddrAny, size),
+	}
+}
+
+// newBatchConn returns a batchConn for the socket which handles up to size datagrams at once
+func newBatchConn(conn *net.UDPConn, size int) batchConn {
+	raw, err := conn.SyscallConn()
+	if err != nil || size <= 1 {
+		return &singleConn{conn}
+	}
+	family := syscall.AF_INET6
+	raw.Control(func(fd uintptr) {
+		if sa, err := syscall.Getsockname(int(fd)); err == nil {
+			if _, ok := sa.(*syscall.SockaddrInet4); ok {
+				family = syscall.AF_INET
+			}
+		}
+	})
+	return &mmsgConn{
+		raw:    raw,
+		family: family,
+		read:   newMmsgBuffers(size),
+		write:  newMmsgBuffers(size),
+	}
+}
+
+func (m *mmsgConn) ReadBatch(msgs []message) (int, error) {
+	count := len(msgs)
+	if count > len(m.read.hdrs) {
+		count = len(m.read.hdrs)
+	}
+	for i := 0; i < count; i++ {
+		m.read.iovs[i].Base = &msgs[i].Buffer[0]
+		m.read.iovs[i].SetLen(len(msgs[i].Buffer))
+		hdr := &m.read.hdrs[i].hdr
+		*hdr = syscall.Msghdr{}
+		hdr.Name = (*byte)(unsafe.Pointer(&m.read.names[i]))
+		hdr.Namelen = syscall.SizeofSockaddrAny
+		hdr.Iov = &m.read.iovs[i]
+		hdr.Iovlen = 1
+	}
+
+	var n int
+	var errno syscall.Errno
+	err := m.raw.Read(func(fd uintptr) bool {
+		r, _, e := syscall.Syscall6(syscall.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&m.read.hdrs[0])),
+			uintptr(count), syscall.MSG_DONTWAIT, 0, 0)
+		n, errno = int(r), e
+		return errno != syscall.EAGAIN
+	})
+	runtime.KeepAlive(msgs)
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, errno
+	}
+	for i := 0; i < n; i++ {
+		msgs[i].N = int(m.read.hdrs[i].len)
+		msgs[i].Truncated = m.read.hdrs[i].hdr.Flags&syscall.MSG_TRUNC != 0
+		msgs[i].Addr = decodeAddr(&m.read.names[i])
+	}
+	return n, nil
+}
+
+func (m *mmsgConn) WriteBatch(msgs []message) error {
+	var lastErr error
+	for len(msgs) > 0 {
+		count := len(msgs)
+		if count > len(m.write.hdrs) {
+			count = len(m.write.hdrs)
+		}
+		for i := 0; i < count; i++ {
+			m.write.iovs[i].Base = &msgs[i].Buffer[0]
+			m.write.iovs[i].SetLen(msgs[i].N)
+			hdr := &m.write.hdrs[i].hdr
+			*hdr = syscall.Msghdr{}
+			hdr.Name = (*byte)(unsafe.Pointer(&m.write.names[i]))
+			hdr.Namelen = encodeAddr(&m.write.names[i], msgs[i].Addr, m.family)
+			hdr.Iov = &m.write.iovs[i]
+			hdr.Iovlen = 1
+		}
+
+		var n int
+		var errno syscall.Errno
+		err := m.raw.Write(func(fd uintptr) bool {
+			r, _, e := syscall.Syscall6(sysSendmmsg, fd, uintptr(unsafe.Pointer(&m.write.hdrs[0])),
+				uintptr(count), syscall.MSG_DONTWAIT, 0, 0)
+			n, errno = int(r), e
+			return errno != syscall.EAGAIN
+		})
+		runtime.KeepAlive(msgs)
+		if err != nil {
+			return err
+		}
+		if errno != 0 {
+			// the first datagram couldn't be sent, skip it and send the rest
+			lastErr = errno
+			n = 1
+		}
+		msgs = msgs[n:]
+	}
+	return lastErr
+}
+
+// decodeAddr converts the address filled in by recvmmsg
+func decodeAddr(name *syscall.RawSockaddrAny) *net.UDPAddr {
+	switch name.Addr.Family {
+	case syscall.AF_INET:
+		sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(name))
+		port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		return &net.UDPAddr{
+			IP:   net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3]),
+			Port: int(port[0])<<8 | int(port[1]),
+		}
+	case syscall.AF_INET6:
+		sa := (*syscall.RawSockaddrInet6)(unsafe.Pointer(name))
+		port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		addr := &net.UDPAddr{
+			IP:   make(net.IP, net.IPv6len),
+			Port: int(port[0])<<8 | int(port[1]),
+		}
+		copy(addr.IP, sa.Addr[:])
+		if sa.Scope_id != 0 {
+			addr.Zone = zone(int(sa.Scope_id))
+		}
+		return addr
+	}
+	return &net.UDPAddr{}
+}
+
+// encodeAddr fills name with the address for sendmmsg and returns its length
+func encodeAddr(name *syscall.RawSockaddrAny, addr *net.UDPAddr, family int) uint32 {
+	if ip4 := addr.IP.To4(); ip4 != nil && family == syscall.AF_INET {
+		sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(name))
+		*sa = syscall.RawSockaddrInet4{Family: syscall.AF_INET}
+		port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		port[0], port[1] = byte(addr.Port>>8), byte(addr.Port)
+		copy(sa.Addr[:], ip4)
+		return syscall.SizeofSockaddrInet4
+	}
+	sa := (*syscall.RawSockaddrInet6)(unsafe.Pointer(name))
+	*sa = syscall.RawSockaddrInet6{Family: syscall.AF_INET6}
+	port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+	port[0], port[1] = byte(addr.Port>>8), byte(addr.Port)
+	copy(sa.Addr[:], addr.IP.To16())
+	if addr.Zone != "" {
+		if ifi, err := net.InterfaceByName(addr.Zone); err == nil {
+			sa.Scope_id = uint32(ifi.Index)
+		} else if index, err := strconv.Atoi(addr.Zone); err == nil {
+			sa.Scope_id = uint32(index)
+		}
+	}
+	return syscall.SizeofSockaddrInet6
+}
+
+func zone(index int) string {
+	if ifi, err := net.InterfaceByIndex(index); err == nil {
+		return ifi.Name
+	}
+	return strconv.Itoa(index)
+}
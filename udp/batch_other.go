@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package udp
+
+import "net"
+
+// newBatchConn returns a batchConn for the socket which reads and writes one datagram at a time
+func newBatchConn(conn *net.UDPConn, size int) batchConn {
+	return &singleConn{conn}
+}
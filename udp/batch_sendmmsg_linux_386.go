@@ -0,0 +1,4 @@
+package udp
+
+// sysSendmmsg is the number of sendmmsg(2), it is missing in the syscall package for 386
+const sysSendmmsg = 345
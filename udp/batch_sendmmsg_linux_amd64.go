@@ -0,0 +1,4 @@
+package udp
+
+// sysSendmmsg is the number of sendmmsg(2), it is missing in the syscall package for amd64
+const sysSendmmsg = 307
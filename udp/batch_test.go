@@ -0,0 +1,94 @@
+package udp
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/worldOneo/glass-proxy/config"
+)
+
+func TestBatchConn(t *testing.T) {
+	for _, size := range []int{1, 4} {
+		for _, network := range []string{"udp4", "udp6"} {
+			testBatchConn(t, network, size)
+		}
+	}
+}
+
+func testBatchConn(t *testing.T, network string, size int) {
+	address := "127.0.0.1:0"
+	if network == "udp6" {
+		address = "[::1]:0"
+	}
+	server, err := net.ListenUDP(network, mustResolve(t, network, address))
+	if err != nil {
+		t.Logf("skipping %s: %v", network, err)
+		return
+	}
+	client, err := net.DialUDP(network, nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		client.Write([]byte(strconv.Itoa(i)))
+	}
+	conn := newBatchConn(server, size)
+	msgs := make([]message, 4)
+	for i := range msgs {
+		msgs[i].Buffer = make([]byte, config.MaxUDPDatagramSize)
+	}
+	server.SetReadDeadline(time.Now().Add(2 * time.Second))
+	received := make([]message, 0)
+	for len(received) < 10 {
+		n, err := conn.ReadBatch(msgs)
+		if err != nil {
+			t.Fatalf("%s: %v", network, err)
+		}
+		for _, msg := range msgs[:n] {
+			data := append([]byte{}, msg.Buffer[:msg.N]...)
+			received = append(received, message{Buffer: data, N: msg.N, Addr: msg.Addr})
+		}
+	}
+	for i, msg := range received {
+		if string(msg.Buffer) != strconv.Itoa(i) {
+			t.Errorf("%s: datagram %d is %q", network, i, msg.Buffer)
+		}
+		if msg.Addr.String() != client.LocalAddr().String() {
+			t.Errorf("%s: datagram from %s, expected %s", network, msg.Addr, client.LocalAddr())
+		}
+	}
+
+	if err := conn.WriteBatch(received); err != nil {
+		t.Fatalf("%s: %v", network, err)
+	}
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buffer := make([]byte, config.MaxUDPDatagramSize)
+	for i := 0; i < 10; i++ {
+		n, err := client.Read(buffer)
+		if err != nil {
+			t.Fatalf("%s: %v", network, err)
+		}
+		if string(buffer[:n]) != strconv.Itoa(i) {
+			t.Errorf("%s: echo %d is %q", network, i, buffer[:n])
+		}
+	}
+
+	client.Write(make([]byte, 200))
+	msgs[0].Buffer = make([]byte, 100)
+	if n, err := conn.ReadBatch(msgs[:1]); err != nil || n != 1 || !msgs[0].Truncated {
+		t.Errorf("%s: expected a truncated datagram, got %d %v %v", network, n, msgs[0].Truncated, err)
+	}
+	client.Close()
+	server.Close()
+}
+
+func mustResolve(t *testing.T, network, address string) *net.UDPAddr {
+	addr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
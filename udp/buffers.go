@@ -0,0 +1,58 @@
+package udp
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// BufferPool reuses the buffers of datagrams passed between goroutines
+type BufferPool struct {
+	pool sync.Pool
+	size int
+}
+
+// NewBufferPool creates a new BufferPool of buffers with the size of the largest datagram
+func NewBufferPool(size int) *BufferPool {
+	b := &BufferPool{size: size}
+	b.pool.New = func() interface{} {
+		buffer := make([]byte, size)
+		return &buffer
+	}
+	return b
+}
+
+// Get returns a buffer of the pool or a new one
+func (b *BufferPool) Get() *[]byte {
+	return b.pool.Get().(*[]byte)
+}
+
+// Put returns the buffer to the pool
+func (b *BufferPool) Put(buffer *[]byte) {
+	b.pool.Put(buffer)
+}
+
+// Size returns the size of the buffers
+func (b *BufferPool) Size() int {
+	return b.size
+}
+
+// TruncationCounter counts the datagrams dropped because they were larger than the buffers
+type TruncationCounter struct {
+	count uint64
+	size  int
+}
+
+// Add counts a truncated datagram. The first and every 1000th are logged.
+func (t *TruncationCounter) Add(from net.Addr) {
+	count := atomic.AddUint64(&t.count, 1)
+	if count == 1 || count%1000 == 0 {
+		log.Printf("Dropped %d datagrams larger than UDPMaxDatagramSize (%d bytes), the last from %s", count, t.size, from)
+	}
+}
+
+// Count returns the amount of truncated datagrams
+func (t *TruncationCounter) Count() uint64 {
+	return atomic.LoadUint64(&t.count)
+}
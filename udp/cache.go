@@ -0,0 +1,431 @@
+package udp
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cacheShards is the amount of shards of a Cache.
+// A Cache with a limit below smallLimit uses a single shard to keep the limit exact.
+const (
+	cacheShards = 64
+	smallLimit  = 1024
+)
+
+// EvictReason is the reason an item left the Cache
+type EvictReason int
+
+const (
+	// Expired items weren't accessed for the expiration time
+	Expired EvictReason = iota
+	// Evicted items were the least recently used ones of a full cache
+	Evicted
+	// Removed items were removed, replaced or cleared
+	Removed
+	// FailedOver items belonged to a host which can't be used anymore
+	FailedOver
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case Expired:
+		return "expired"
+	case Evicted:
+		return "evicted"
+	case FailedOver:
+		return "failed over"
+	default:
+		return "removed"
+	}
+}
+
+// EvictFunc is called for every item leaving the cache
+type EvictFunc func(addr *net.UDPAddr, value interface{}, reason EvictReason)
+
+// Cache stores items by client address in shards with their own lock.
+// Getting an item only takes the read lock of its shard and updates its access time atomically.
+// Items expire once they weren't accessed for the expiration time and the least recently used
+// items are evicted once the cache is full (approximately, see leastRecentlyUsed).
+type Cache struct {
+	shards      []*cacheShard
+	holdingTime time.Duration
+	onEvict     EvictFunc
+	wheel       *timingWheel
+}
+
+// cacheKey identifies the address of a client without allocating
+type cacheKey struct {
+	ip   [net.IPv6len]byte
+	port int
+	zone string
+}
+
+// Item an item holding a value and its last access time.
+// The access time is used to determine if an item should be removed.
+type Item struct {
+	access int64 // UnixNano, atomic (first to be 64 bit aligned)
+	listed int64 // access time when the item was last moved in the lru list
+	value  interface{}
+	addr   *net.UDPAddr
+	key    cacheKey
+	lru    *list.Element
+	slot   int
+}
+
+// cacheShard is a part of the cache with its own lock and limit
+type cacheShard struct {
+	sync.RWMutex
+	items map[cacheKey]*Item
+	lru   *list.List
+	max   int
+}
+
+// eviction is an item which left the cache and waits for its callback
+type eviction struct {
+	item   *Item
+	reason EvictReason
+}
+
+// NewCache creates a new cache.
+// Items are removed after not being accessed for expireAfter,
+// the least recently used items are removed once there are more than maxItems (0 = unlimited).
+// onEvict (may be nil) is called for every item leaving the cache.
+func NewCache(expireAfter time.Duration, maxItems int, onEvict EvictFunc) *Cache {
+	shards := cacheShards
+	if maxItems > 0 && maxItems < smallLimit {
+		shards = 1
+	}
+	cache := &Cache{
+		shards:      make([]*cacheShard, shards),
+		holdingTime: expireAfter,
+		onEvict:     onEvict,
+	}
+	for i := range cache.shards {
+		cache.shards[i] = &cacheShard{
+			items: make(map[cacheKey]*Item),
+			lru:   list.New(),
+			max:   (maxItems + shards - 1) / shards,
+		}
+	}
+	cache.wheel = newTimingWheel(expireAfter, cache.expire)
+	return cache
+}
+
+// keyOf returns the key of the address
+func keyOf(addr *net.UDPAddr) cacheKey {
+	key := cacheKey{port: addr.Port, zone: addr.Zone}
+	copy(key.ip[:], addr.IP.To16())
+	return key
+}
+
+// shard returns the shard of the key
+func (U *Cache) shard(key cacheKey) *cacheShard {
+	hash := uint32(2166136261)
+	for _, b := range key.ip {
+		hash = (hash ^ uint32(b)) * 16777619
+	}
+	hash = (hash ^ uint32(key.port)) * 16777619
+	return U.shards[hash%uint32(len(U.shards))]
+}
+
+// Put puts the ip and its corresponding item into the cache
+func (U *Cache) Put(ip *net.UDPAddr, value interface{}) {
+	key := keyOf(ip)
+	shard := U.shard(key)
+	var evicted []eviction
+	shard.Lock()
+	if old, ok := shard.items[key]; ok {
+		U.unlink(shard, old)
+		evicted = append(evicted, eviction{old, Removed})
+	}
+	evicted = U.insert(shard, ip, key, value, evicted)
+	shard.Unlock()
+	U.evict(evicted)
+}
+
+// Replace replaces the value of the ip with next if it is still old.
+// The old item leaves the cache for the reason.
+func (U *Cache) Replace(ip *net.UDPAddr, old, next interface{}, reason EvictReason) bool {
+	key := keyOf(ip)
+	shard := U.shard(key)
+	shard.Lock()
+	item, ok := shard.items[key]
+	if !ok || item.value != old {
+		shard.Unlock()
+		return false
+	}
+	U.unlink(shard, item)
+	evicted := U.insert(shard, ip, key, next, []eviction{{item, reason}})
+	shard.Unlock()
+	U.evict(evicted)
+	return true
+}
+
+// CompareAndRemove removes the item of the ip for the reason if its value is still old
+func (U *Cache) CompareAndRemove(ip *net.UDPAddr, old interface{}, reason EvictReason) bool {
+	key := keyOf(ip)
+	shard := U.shard(key)
+	shard.Lock()
+	item, ok := shard.items[key]
+	if !ok || item.value != old {
+		shard.Unlock()
+		return false
+	}
+	U.unlink(shard, item)
+	shard.Unlock()
+	U.evict([]eviction{{item, reason}})
+	return true
+}
+
+// insert adds a new item to the locked shard and evicts the least recently used items if it is full
+func (U *Cache) insert(shard *cacheShard, ip *net.UDPAddr, key cacheKey, value interface{}, evicted []eviction) []eviction {
+	now := time.Now().UnixNano()
+	item := &Item{
+		access: now,
+		listed: now,
+		value:  value,
+		addr:   ip,
+		key:    key,
+		slot:   -1,
+	}
+	shard.items[key] = item
+	item.lru = shard.lru.PushBack(item)
+	U.wheel.schedule(item, now+int64(U.holdingTime))
+	for shard.max > 0 && len(shard.items) > shard.max {
+		evicted = append(evicted, eviction{U.leastRecentlyUsed(shard, item), Evicted})
+	}
+	return evicted
+}
+
+// leastRecentlyUsed removes and returns the least recently used item of the shard except keep.
+// Items accessed since they were moved in the list get a second chance and are moved to its back
+// (in list order, not access order) so Get doesn't need the write lock.
+func (U *Cache) leastRecentlyUsed(shard *cacheShard, keep *Item) *Item {
+	for {
+		item := shard.lru.Front().Value.(*Item)
+		if item == keep {
+			shard.lru.MoveToBack(item.lru)
+			continue
+		}
+		access := atomic.LoadInt64(&item.access)
+		if access > item.listed {
+			item.listed = access
+			shard.lru.MoveToBack(item.lru)
+			continue
+		}
+		U.unlink(shard, item)
+		return item
+	}
+}
+
+// unlink removes the item from the shard and the timing wheel, the shard must be locked
+func (U *Cache) unlink(shard *cacheShard, item *Item) {
+	delete(shard.items, item.key)
+	shard.lru.Remove(item.lru)
+	U.wheel.unschedule(item)
+}
+
+// evict calls the callback for the evicted items
+func (U *Cache) evict(evicted []eviction) {
+	if U.onEvict == nil {
+		return
+	}
+	for _, e := range evicted {
+		U.onEvict(e.item.addr, e.item.value, e.reason)
+	}
+}
+
+// Remove forces the ip out of the cache
+func (U *Cache) Remove(ip *net.UDPAddr) {
+	key := keyOf(ip)
+	shard := U.shard(key)
+	shard.Lock()
+	item, ok := shard.items[key]
+	if ok {
+		U.unlink(shard, item)
+	}
+	shard.Unlock()
+	if ok {
+		U.evict([]eviction{{item, Removed}})
+	}
+}
+
+// Get returns the stored item coresbonding to a clients IP and marks it as accessed
+func (U *Cache) Get(ip *net.UDPAddr) interface{} {
+	key := keyOf(ip)
+	shard := U.shard(key)
+	shard.RLock()
+	defer shard.RUnlock()
+	item := shard.items[key]
+	if item == nil {
+		return nil
+	}
+	atomic.StoreInt64(&item.access, time.Now().UnixNano())
+	return item.value
+}
+
+// Touch marks the item of the ip as accessed and returns if there is one
+func (U *Cache) Touch(ip *net.UDPAddr) bool {
+	return U.Get(ip) != nil
+}
+
+// Len returns the amount of items in the cache
+func (U *Cache) Len() int {
+	count := 0
+	for _, shard := range U.shards {
+		shard.RLock()
+		count += len(shard.items)
+		shard.RUnlock()
+	}
+	return count
+}
+
+// Range calls f for every item stored in the cache.
+// f must not modify the cache.
+func (U *Cache) Range(f func(addr *net.UDPAddr, value interface{})) {
+	for _, shard := range U.shards {
+		shard.RLock()
+		for _, item := range shard.items {
+			f(item.addr, item.value)
+		}
+		shard.RUnlock()
+	}
+}
+
+// RemoveFunc removes every item for which f returns true
+func (U *Cache) RemoveFunc(f func(addr *net.UDPAddr, value interface{}) bool) {
+	var evicted []eviction
+	for _, shard := range U.shards {
+		shard.Lock()
+		for _, item := range shard.items {
+			if f(item.addr, item.value) {
+				U.unlink(shard, item)
+				evicted = append(evicted, eviction{item, Removed})
+			}
+		}
+		shard.Unlock()
+	}
+	U.evict(evicted)
+}
+
+// Clear removes every item from the cache
+func (U *Cache) Clear() {
+	U.RemoveFunc(func(*net.UDPAddr, interface{}) bool { return true })
+}
+
+// expire removes the due items which weren't accessed for the expiration time
+// and schedules the others again
+func (U *Cache) expire(due []*Item) {
+	var evicted []eviction
+	now := time.Now().UnixNano()
+	for _, item := range due {
+		shard := U.shard(item.key)
+		shard.Lock()
+		if shard.items[item.key] == item {
+			deadline := atomic.LoadInt64(&item.access) + int64(U.holdingTime)
+			if deadline <= now {
+				U.unlink(shard, item)
+				evicted = append(evicted, eviction{item, Expired})
+			} else {
+				U.wheel.schedule(item, deadline)
+			}
+		}
+		shard.Unlock()
+	}
+	U.evict(evicted)
+}
+
+// wheelSlots is the amount of slots of a timingWheel.
+// An item is at most half of them ahead so the wheel never wraps around it.
+const wheelSlots = 64
+
+// timingWheel passes the items to expire once their deadline is due.
+// It only runs while there are scheduled items.
+type timingWheel struct {
+	sync.Mutex
+	slots   []map[*Item]struct{}
+	current int
+	tick    time.Duration
+	items   int
+	running bool
+	expire  func([]*Item)
+}
+
+// newTimingWheel creates a timingWheel for deadlines up to span ahead
+func newTimingWheel(span time.Duration, expire func([]*Item)) *timingWheel {
+	tick := span / (wheelSlots / 2)
+	if tick < time.Millisecond {
+		tick = time.Millisecond
+	}
+	w := &timingWheel{
+		slots:  make([]map[*Item]struct{}, wheelSlots),
+		tick:   tick,
+		expire: expire,
+	}
+	for i := range w.slots {
+		w.slots[i] = make(map[*Item]struct{})
+	}
+	return w
+}
+
+// schedule puts the item into the slot of the deadline (UnixNano)
+func (w *timingWheel) schedule(item *Item, deadline int64) {
+	w.Lock()
+	defer w.Unlock()
+	w.remove(item)
+	offset := int((time.Duration(deadline-time.Now().UnixNano()) + w.tick - 1) / w.tick)
+	if offset < 1 {
+		offset = 1
+	} else if offset >= wheelSlots {
+		offset = wheelSlots - 1
+	}
+	item.slot = (w.current + offset) % wheelSlots
+	w.slots[item.slot][item] = struct{}{}
+	w.items++
+	if !w.running {
+		w.running = true
+		time.AfterFunc(w.tick, w.advance)
+	}
+}
+
+// unschedule removes the item from its slot
+func (w *timingWheel) unschedule(item *Item) {
+	w.Lock()
+	defer w.Unlock()
+	w.remove(item)
+}
+
+func (w *timingWheel) remove(item *Item) {
+	if item.slot < 0 {
+		return
+	}
+	delete(w.slots[item.slot], item)
+	item.slot = -1
+	w.items--
+}
+
+// advance moves the wheel to the next slot and expires its items
+func (w *timingWheel) advance() {
+	w.Lock()
+	w.current = (w.current + 1) % wheelSlots
+	slot := w.slots[w.current]
+	due := make([]*Item, 0, len(slot))
+	for item := range slot {
+		due = append(due, item)
+	}
+	for _, item := range due {
+		w.remove(item)
+	}
+	if w.items > 0 {
+		time.AfterFunc(w.tick, w.advance)
+	} else {
+		w.running = false
+	}
+	w.Unlock()
+	if len(due) > 0 {
+		w.expire(due)
+	}
+}
@@ -0,0 +1,95 @@
+package udp
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// evictions records the evicted items of a cache
+type evictions struct {
+	sync.Mutex
+	reasons map[string]EvictReason
+}
+
+func (e *evictions) add(addr *net.UDPAddr, value interface{}, reason EvictReason) {
+	e.Lock()
+	defer e.Unlock()
+	e.reasons[addr.String()] = reason
+}
+
+func (e *evictions) get(addr *net.UDPAddr) (EvictReason, bool) {
+	e.Lock()
+	defer e.Unlock()
+	reason, ok := e.reasons[addr.String()]
+	return reason, ok
+}
+
+func clientAddr(port int) *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+}
+
+func TestCacheExpires(t *testing.T) {
+	evicted := &evictions{reasons: make(map[string]EvictReason)}
+	cache := NewCache(100*time.Millisecond, 0, evicted.add)
+	idle, active := clientAddr(1), clientAddr(2)
+	cache.Put(idle, 1)
+	cache.Put(active, 2)
+	for i := 0; i < 6; i++ {
+		time.Sleep(40 * time.Millisecond)
+		cache.Touch(active)
+	}
+
+	if cache.Get(idle) != nil {
+		t.Error("idle item didn't expire")
+	}
+	if reason, ok := evicted.get(idle); !ok || reason != Expired {
+		t.Errorf("idle item evicted %v (%v), expected expired", ok, reason)
+	}
+	if cache.Get(active) != 2 {
+		t.Error("accessed item expired")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if cache.Len() != 0 {
+		t.Errorf("%d items left, expected none", cache.Len())
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	evicted := &evictions{reasons: make(map[string]EvictReason)}
+	cache := NewCache(time.Minute, 3, evicted.add)
+	for port := 1; port <= 3; port++ {
+		cache.Put(clientAddr(port), port)
+		time.Sleep(time.Millisecond)
+	}
+	cache.Get(clientAddr(1))
+	cache.Put(clientAddr(4), 4)
+
+	if reason, ok := evicted.get(clientAddr(2)); !ok || reason != Evicted {
+		t.Errorf("least recently used item evicted %v (%v), expected evicted", ok, reason)
+	}
+	for _, port := range []int{1, 3, 4} {
+		if cache.Get(clientAddr(port)) != port {
+			t.Errorf("item %d was evicted", port)
+		}
+	}
+
+	for _, port := range []int{1, 3, 4} {
+		cache.Get(clientAddr(port))
+	}
+	cache.Put(clientAddr(5), 5)
+	if cache.Get(clientAddr(5)) != 5 || cache.Len() != 3 {
+		t.Errorf("new item was evicted or the limit exceeded with %d items", cache.Len())
+	}
+
+	cache.Put(clientAddr(5), 6)
+	cache.Remove(clientAddr(5))
+	if reason, ok := evicted.get(clientAddr(5)); !ok || reason != Removed {
+		t.Errorf("removed item evicted %v (%v), expected removed", ok, reason)
+	}
+	cache.Clear()
+	if cache.Len() != 0 {
+		t.Errorf("%d items left after clearing", cache.Len())
+	}
+}
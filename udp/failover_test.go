@@ -0,0 +1,171 @@
+package udp
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/worldOneo/glass-proxy/config"
+)
+
+// startNamedServer starts a UDP server which answers every datagram with its name
+func startNamedServer(t *testing.T, name string) string {
+	conn, err := net.ListenUDP("udp", mustResolve(t, "udp", "127.0.0.1:0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buffer := make([]byte, 1024)
+		for {
+			_, addr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP([]byte(name), addr)
+		}
+	}()
+	t.Cleanup(func() { conn.Close() })
+	return conn.LocalAddr().String()
+}
+
+// startSilentServer starts a UDP server which never answers
+func startSilentServer(t *testing.T) string {
+	conn, err := net.ListenUDP("udp", mustResolve(t, "udp", "127.0.0.1:0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn.LocalAddr().String()
+}
+
+// startService starts a UDP proxy service and returns it once it listens
+func startService(t *testing.T, cnf *config.Config) (*Service, *net.UDPAddr) {
+	p := NewService(cnf)
+	go p.Run()
+	for i := 0; i < 100; i++ {
+		p.Lock()
+		conns := p.serviceConns
+		p.Unlock()
+		if len(conns) > 0 {
+			t.Cleanup(func() { p.Shutdown(0) })
+			return p, conns[0].LocalAddr().(*net.UDPAddr)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("the service didn't start")
+	return nil, nil
+}
+
+// request sends a datagram through the proxy and returns the answer
+func request(t *testing.T, client *net.UDPConn) string {
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buffer := make([]byte, 1024)
+	n, err := client.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buffer[:n])
+}
+
+func TestSessionFailover(t *testing.T) {
+	cnf := config.Default()
+	cnf.Protocol = "udp"
+	cnf.Addr = "127.0.0.1:0"
+	cnf.LogConfig = config.LogConfig{}
+	cnf.Hosts = []config.HostConfig{
+		{Name: "a", Addr: startNamedServer(t, "a")},
+		{Name: "b", Addr: startNamedServer(t, "b")},
+	}
+	p, addr := startService(t, cnf)
+	client, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	first := request(t, client)
+	other := map[string]string{"a": "b", "b": "a"}[first]
+	p.RemHost(first)
+	if answer := request(t, client); answer != other {
+		t.Fatalf("answer from %q after removing %q, expected %q", answer, first, other)
+	}
+	sessions := p.Sessions()
+	if len(sessions) != 1 || sessions[0].Host != other || sessions[0].PacketsUp != 2 {
+		t.Errorf("expected the moved session on %s with 2 datagrams, got %+v", other, sessions)
+	}
+
+	p.UpdateConfig(func(cnf *config.Config) error {
+		cnf.UDPFailover = config.FailoverClose
+		return nil
+	})
+	p.AddHost(config.HostConfig{Name: first, Addr: startNamedServer(t, first)})
+	p.SetHostState(other, config.HostDisabled)
+	if sessions := p.Sessions(); len(sessions) != 0 {
+		t.Errorf("expected the session to be closed, got %+v", sessions)
+	}
+	if answer := request(t, client); answer != first {
+		t.Errorf("answer from %q after disabling %q, expected %q", answer, other, first)
+	}
+	if moved, closed := p.Failovers(); moved != 1 || closed != 1 {
+		t.Errorf("%d sessions moved and %d closed, expected 1 each", moved, closed)
+	}
+}
+
+func TestOfflineFailover(t *testing.T) {
+	a, err := net.ListenUDP("udp", mustResolve(t, "udp", "127.0.0.1:0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buffer := make([]byte, 1024)
+		for {
+			_, addr, err := a.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			a.WriteToUDP([]byte("a"), addr)
+		}
+	}()
+	defer a.Close()
+
+	cnf := config.Default()
+	cnf.Protocol = "udp"
+	cnf.Addr = "127.0.0.1:0"
+	cnf.LogConfig = config.LogConfig{}
+	cnf.HealthCheckTime = 0.05
+	cnf.Hosts = []config.HostConfig{
+		{Name: "a", Addr: a.LocalAddr().String(), Priority: 0},
+		{Name: "b", Addr: startNamedServer(t, "b"), Priority: 1},
+	}
+	// silent servers take the whole probe timeout, they are probed at once
+	for i := 0; i < 4; i++ {
+		cnf.Hosts = append(cnf.Hosts, config.HostConfig{Name: fmt.Sprintf("silent-%d", i), Addr: startSilentServer(t), Priority: 2})
+	}
+	p, addr := startService(t, cnf)
+	client, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if answer := request(t, client); answer != "a" {
+		t.Fatalf("answer from %q, expected the preferred a", answer)
+	}
+
+	a.Close()
+	for i := 0; i < 250; i++ {
+		if moved, _ := p.Failovers(); moved == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if moved, closed := p.Failovers(); moved != 1 || closed != 0 {
+		t.Fatalf("%d sessions moved and %d closed after a went offline, expected 1 moved", moved, closed)
+	}
+	if answer := request(t, client); answer != "b" {
+		t.Errorf("answer from %q after a went offline, expected b", answer)
+	}
+}
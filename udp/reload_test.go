@@ -0,0 +1,57 @@
+package udp
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/worldOneo/glass-proxy/config"
+	"github.com/worldOneo/glass-proxy/proxy"
+)
+
+func TestReload(t *testing.T) {
+	cnf := config.Default()
+	cnf.Protocol = "udp"
+	cnf.Addr = "127.0.0.1:0"
+	cnf.LogConfig = config.LogConfig{}
+	cnf.Hosts = []config.HostConfig{
+		{Name: "a", Addr: startNamedServer(t, "a")},
+		{Name: "b", Addr: startNamedServer(t, "b"), Priority: 1},
+	}
+	p, addr := startService(t, cnf)
+	client, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if answer := request(t, client); answer != "a" {
+		t.Fatalf("answer from %q, expected the preferred a", answer)
+	}
+	a := proxy.FindHost(p, "a")
+
+	next := p.GetConfig()
+	next.Hosts = []config.HostConfig{next.Hosts[0], {Name: "c", Addr: startNamedServer(t, "c"), Priority: 1}}
+	next.UDPTimeout++
+	next.UDPFailover = config.FailoverClose
+	restart := proxy.Reload(p, next)
+
+	if !reflect.DeepEqual(restart, []string{"UDPTimeout"}) {
+		t.Errorf("expected UDPTimeout to need a restart, got %v", restart)
+	}
+	if proxy.FindHost(p, "a") != a {
+		t.Fatal("unchanged host was replaced")
+	}
+	if proxy.FindHost(p, "b") != nil || proxy.FindHost(p, "c") == nil {
+		t.Errorf("expected b to be removed and c to be added, got %v", p.ListHosts())
+	}
+	if sessions := p.Sessions(); len(sessions) != 1 || sessions[0].Host != "a" {
+		t.Errorf("expected the session to stay on the unchanged host, got %+v", sessions)
+	}
+	if answer := request(t, client); answer != "a" {
+		t.Errorf("answer from %q after the reload, expected a", answer)
+	}
+	if cnf := p.GetConfig(); cnf.UDPFailover != config.FailoverClose || cnf.UDPTimeout == next.UDPTimeout {
+		t.Errorf("expected UDPFailover to apply and UDPTimeout to wait for a restart, got %s and %d",
+			cnf.UDPFailover, cnf.UDPTimeout)
+	}
+}
@@ -0,0 +1,83 @@
+package udp
+
+import (
+	"log"
+	"net"
+	"sync"
+)
+
+// reply is a datagram of a host waiting to be sent to its client
+type reply struct {
+	buffer *[]byte
+	n      int
+	addr   *net.UDPAddr
+}
+
+// Replier sends the datagrams of the hosts back to their clients in batches
+type Replier struct {
+	queue    chan reply
+	buffers  *BufferPool
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// NewReplier creates a new Replier which queues up to size datagrams.
+// The buffers of sent datagrams are returned to the pool.
+func NewReplier(size int, buffers *BufferPool) *Replier {
+	return &Replier{
+		queue:   make(chan reply, size),
+		buffers: buffers,
+		stopped: make(chan struct{}),
+	}
+}
+
+// Send queues the first n bytes of the buffer to be sent to addr.
+// The buffer must be taken from the pool of the Replier and is returned to it once sent.
+func (r *Replier) Send(buffer *[]byte, n int, addr *net.UDPAddr) {
+	select {
+	case r.queue <- reply{buffer: buffer, n: n, addr: addr}:
+	case <-r.stopped:
+		r.buffers.Put(buffer)
+	}
+}
+
+// Run writes the queued datagrams to conn, up to batchSize at once, until the Replier is stopped
+func (r *Replier) Run(conn batchConn, batchSize int) {
+	replies := make([]reply, 0, batchSize)
+	msgs := make([]message, 0, batchSize)
+	for {
+		select {
+		case next := <-r.queue:
+			replies = append(replies, next)
+		case <-r.stopped:
+			return
+		}
+	collect:
+		for len(replies) < batchSize {
+			select {
+			case next := <-r.queue:
+				replies = append(replies, next)
+			default:
+				break collect
+			}
+		}
+
+		for _, next := range replies {
+			msgs = append(msgs, message{Buffer: *next.buffer, N: next.n, Addr: next.addr})
+		}
+		if err := conn.WriteBatch(msgs); err != nil {
+			log.Printf("Unable to forward datagram (server->proxy-Xclient): %v", err)
+		}
+		for _, next := range replies {
+			r.buffers.Put(next.buffer)
+		}
+		replies, msgs = replies[:0], msgs[:0]
+	}
+}
+
+// Stop stops sending datagrams, queued datagrams are dropped
+func (r *Replier) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.stopped)
+	})
+}
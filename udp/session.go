@@ -0,0 +1,113 @@
+package udp
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/worldOneo/glass-proxy/handler"
+	"github.com/worldOneo/glass-proxy/proxy"
+)
+
+// Session is a client relayed to a host through its own upstream socket.
+// The sessions are owned by the session table of the service,
+// a session leaving the table is closed which stops its relay.
+type Session struct {
+	packetsUp   uint64 // atomic counters first to be 64 bit aligned
+	packetsDown uint64
+	bytesUp     uint64
+	bytesDown   uint64
+	lastActive  int64 // UnixNano
+	closed      int32 // EvictReason + 1 once the session left the table
+	released    int32
+	release     func()
+	client      *net.UDPAddr
+	host        *host
+	endpoint    *net.UDPAddr
+	conn        *net.UDPConn
+	replier     *Replier
+	bandwidth   *handler.Bandwidth
+	started     time.Time
+}
+
+// newSession creates a session of the client to the endpoint of the host replying through the replier.
+// release is called once the session is closed unless it was taken over by another session.
+func newSession(client *net.UDPAddr, h *host, endpoint *net.UDPAddr, conn *net.UDPConn, replier *Replier, bandwidth *handler.Bandwidth, release func()) *Session {
+	now := time.Now()
+	return &Session{
+		release:    release,
+		lastActive: now.UnixNano(),
+		client:     client,
+		host:       h,
+		endpoint:   endpoint,
+		conn:       conn,
+		replier:    replier,
+		bandwidth:  bandwidth,
+		started:    now,
+	}
+}
+
+// takeRelease returns the release function of the session once and nil afterwards
+func (s *Session) takeRelease() func() {
+	if atomic.CompareAndSwapInt32(&s.released, 0, 1) {
+		return s.release
+	}
+	return nil
+}
+
+// inherit continues the counters of the session it replaces
+func (s *Session) inherit(old *Session) {
+	s.started = old.started
+	atomic.StoreUint64(&s.packetsUp, atomic.LoadUint64(&old.packetsUp))
+	atomic.StoreUint64(&s.packetsDown, atomic.LoadUint64(&old.packetsDown))
+	atomic.StoreUint64(&s.bytesUp, atomic.LoadUint64(&old.bytesUp))
+	atomic.StoreUint64(&s.bytesDown, atomic.LoadUint64(&old.bytesDown))
+}
+
+// Host returns the host the session is relayed to
+func (s *Session) Host() Host {
+	return s.host
+}
+
+// upstream counts a datagram of n bytes sent to the host
+func (s *Session) upstream(n int) {
+	atomic.AddUint64(&s.packetsUp, 1)
+	atomic.AddUint64(&s.bytesUp, uint64(n))
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+// downstream counts a datagram of n bytes sent back to the client
+func (s *Session) downstream(n int) {
+	atomic.AddUint64(&s.packetsDown, 1)
+	atomic.AddUint64(&s.bytesDown, uint64(n))
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+// close closes the upstream socket once and remembers why
+func (s *Session) close(reason EvictReason) {
+	if atomic.CompareAndSwapInt32(&s.closed, 0, int32(reason)+1) {
+		s.conn.Close()
+	}
+}
+
+// closedReason returns why the session was closed and if it was closed by the table
+func (s *Session) closedReason() (EvictReason, bool) {
+	closed := atomic.LoadInt32(&s.closed)
+	return EvictReason(closed - 1), closed != 0
+}
+
+// Info returns a snapshot of the session
+func (s *Session) Info() proxy.SessionInfo {
+	return proxy.SessionInfo{
+		Client:      s.client.String(),
+		Host:        s.host.Name,
+		Endpoint:    s.endpoint.String(),
+		Upstream:    s.conn.LocalAddr().String(),
+		Started:     s.started,
+		LastActive:  time.Unix(0, atomic.LoadInt64(&s.lastActive)),
+		PacketsUp:   atomic.LoadUint64(&s.packetsUp),
+		PacketsDown: atomic.LoadUint64(&s.packetsDown),
+		BytesUp:     atomic.LoadUint64(&s.bytesUp),
+		BytesDown:   atomic.LoadUint64(&s.bytesDown),
+	}
+}
@@ -0,0 +1,47 @@
+package udp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/worldOneo/glass-proxy/config"
+)
+
+// floodConn returns a full batch of datagrams on every read
+type floodConn struct{}
+
+func (floodConn) ReadBatch(msgs []message) (int, error) {
+	for i := range msgs {
+		msgs[i].N = copy(msgs[i].Buffer, "ping")
+		msgs[i].Addr = &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 40000}
+	}
+	return len(msgs), nil
+}
+
+func (floodConn) WriteBatch(msgs []message) error {
+	return nil
+}
+
+func TestShutdownWithFullQueues(t *testing.T) {
+	cnf := config.Default()
+	cnf.Protocol = "udp"
+	p := NewService(cnf)
+	workers := []chan packet{make(chan packet, 4)}
+
+	stopped := make(chan struct{})
+	go func() {
+		p.read(floodConn{}, nil, workers, 8)
+		close(stopped)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if len(workers[0]) != cap(workers[0]) {
+		t.Fatal("the queue didn't fill up")
+	}
+	p.Shutdown(0)
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the reader blocked on the full queue after the shutdown")
+	}
+}
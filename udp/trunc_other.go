@@ -0,0 +1,7 @@
+//go:build windows || js || plan9 || wasip1 || aix
+// +build windows js plan9 wasip1 aix
+
+package udp
+
+// msgTrunc isn't reported on this system (Windows fails to read truncated datagrams instead)
+const msgTrunc = 0
@@ -0,0 +1,9 @@
+//go:build !windows && !js && !plan9 && !wasip1 && !aix
+// +build !windows,!js,!plan9,!wasip1,!aix
+
+package udp
+
+import "syscall"
+
+// msgTrunc is the flag of a datagram which didn't fit into the buffer
+const msgTrunc = syscall.MSG_TRUNC
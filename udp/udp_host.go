@@ -4,29 +4,40 @@ import (
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/worldOneo/glass-proxy/config"
+	"github.com/worldOneo/glass-proxy/handler"
 	"github.com/worldOneo/glass-proxy/proxy"
 )
 
 // Host type of proxy.Host with Connect for UDP
 type Host interface {
 	proxy.Host
-	Connect([]byte, *net.UDPAddr, *net.UDPConn) error
+	Open(*net.UDPAddr, *Replier, func()) (*Session, error)
+	Forward(*Session, []byte) error
 	HealthCheck() (bool, error)
+	SetBandwidth(host, connection int64)
 }
 
 // host contains a config and a status about this host
 type host struct {
-	Name              string
-	Addr              string
-	Protocol          string
-	LogCon            bool
-	LogDis            bool
-	Timeout           time.Duration
-	UDPAddr           *net.UDPAddr
-	Status            *HostStatus
-	ClientServerCache *Cache
+	Name           string
+	Addr           string
+	Protocol       string
+	Priority       int
+	Weight         int
+	Config         *proxy.ConfigStore
+	Resolver       *proxy.Resolver
+	Status         *HostStatus
+	SessionTable   *Cache
+	Relays         *proxy.ConnTracker
+	Bandwidth      *handler.Bandwidth
+	TotalBandwidth *handler.Bandwidth
+	Buffers        *BufferPool
+	Truncated      *TruncationCounter
+	removed        int32
 }
 
 // HostStatus contains *dynamic* information about a host e.g: Health
@@ -34,31 +45,113 @@ type HostStatus struct {
 	proxy.HostStatus
 	sync.RWMutex
 	Online      bool
+	State       string
 	Connections int
 }
 
-// NewHost returns a new Host
-func NewHost(name, addr, prot string, timeout int, lc, ld bool) Host {
-	udpAddr, _ := net.ResolveUDPAddr("udp", addr)
+// NewHost returns a new Host sharing the config, relays and limits of the service.
+// Its address is resolved in the background.
+func NewHost(hostconfig config.HostConfig, p *Service) Host {
+	cnf := p.Config.Get()
 	host := &host{
-		LogCon:            lc,
-		LogDis:            ld,
-		Protocol:          prot,
-		UDPAddr:           udpAddr,
-		ClientServerCache: NewCache(time.Duration(timeout) * time.Second),
-		Timeout:           time.Duration(timeout),
-		Name:              name,
-		Addr:              addr,
+		Config:         p.Config,
+		SessionTable:   p.SessionTable,
+		Protocol:       cnf.Protocol,
+		Name:           hostconfig.Name,
+		Addr:           hostconfig.Addr,
+		Priority:       hostconfig.Priority,
+		Weight:         hostconfig.GetWeight(),
+		Relays:         p.Connections,
+		Bandwidth:      handler.NewBandwidth(cnf.Bandwidth.HostBytesPerSecond),
+		TotalBandwidth: p.Bandwidth,
+		Buffers:        p.Buffers,
+		Truncated:      p.Truncated,
 		Status: &HostStatus{
 			Online: true,
+			State:  hostconfig.GetState(),
 		},
 	}
+	host.Resolver = proxy.NewResolver(hostconfig.Name, hostconfig.Addr, cnf.Protocol, nil, host.endpointsChanged)
+	go host.Resolver.Resolve()
 	return host
 }
 
-// HealthCheck let this host perform a health check and updates it health information
+// endpointsChanged closes the sessions to removed endpoints, their clients get a new session with their next datagram
+func (U *host) endpointsChanged(added, removed []string) {
+	gone := make(map[string]bool, len(removed))
+	for _, endpoint := range removed {
+		gone[endpoint] = true
+	}
+	U.SessionTable.RemoveFunc(func(addr *net.UDPAddr, value interface{}) bool {
+		s := value.(*Session)
+		return s.host == U && gone[s.endpoint.String()]
+	})
+}
+
+// GetResolver returns the resolver of the address of the host
+func (U *host) GetResolver() *proxy.Resolver {
+	return U.Resolver
+}
+
+// GetPriority returns the priority of the host, lower is preferred
+func (U *host) GetPriority() int {
+	return U.Priority
+}
+
+// GetWeight returns the weight of the host among hosts of the same priority
+func (U *host) GetWeight() int {
+	return U.Weight
+}
+
+// HealthCheck sends an empty datagram to each endpoint of the host and updates its health information.
+// An endpoint is offline if the datagram is refused (ICMP port unreachable), no answer counts as online
+// as UDP servers don't have to answer. The host is online if any of its endpoints is.
 func (U *host) HealthCheck() (bool, error) {
-	return true, nil
+	endpoints := U.Resolver.Endpoints()
+	errs := make([]error, len(endpoints))
+	wg := sync.WaitGroup{}
+	for i, endpoint := range endpoints {
+		wg.Add(1)
+		go func(i int, endpoint string) {
+			defer wg.Done()
+			errs[i] = probe(U.Protocol, endpoint)
+		}(i, endpoint)
+	}
+	wg.Wait()
+
+	U.Status.Lock()
+	defer U.Status.Unlock()
+	U.Status.Online = false
+	var err error
+	for i := range endpoints {
+		if errs[i] == nil {
+			U.Status.Online = true
+		} else {
+			err = errs[i]
+		}
+	}
+	if U.Status.Online {
+		err = nil
+	}
+	return U.Status.Online, err
+}
+
+// probe sends an empty datagram to the endpoint and returns an error if it is refused
+func probe(protocol, endpoint string) error {
+	conn, err := net.DialTimeout(protocol, endpoint, 2*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Write(nil); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return nil
+	}
+	return err
 }
 
 func (U *host) GetAddr() string {
@@ -73,69 +166,144 @@ func (U *host) GetStatus() proxy.HostStatus {
 	return U.Status
 }
 
-// IsOnline (not implemented) returns true
+// IsOnline returns if the last health check didn't find the host offline
 func (U *HostStatus) IsOnline() bool {
-	return true
+	U.RLock()
+	defer U.RUnlock()
+	return U.Online
 }
 
-type udpData struct {
-	buffer, oob []byte
+// GetState returns the administrative state of the host
+func (U *HostStatus) GetState() string {
+	U.RLock()
+	defer U.RUnlock()
+	return U.State
 }
 
-func (U *host) Connect(buff []byte, clientaddr *net.UDPAddr, serviceconn *net.UDPConn) (err error) {
-	var conn net.PacketConn
+// SetState sets the administrative state of this host
+func (U *host) SetState(state string) {
+	U.Status.Lock()
+	defer U.Status.Unlock()
+	U.Status.State = state
+}
 
-	testConn := U.ClientServerCache.Get(clientaddr)
-	if testConn == nil {
-		conn, err = net.ListenPacket(U.Protocol, ":0")
-		if err != nil {
-			log.Printf("Error dialing host: %v", err)
-			return err
+// CloseConnections closes every session of this host
+func (U *host) CloseConnections() {
+	U.SessionTable.RemoveFunc(func(addr *net.UDPAddr, value interface{}) bool {
+		return value.(*Session).host == U
+	})
+}
+
+// SetBandwidth changes the bandwidth limit of this host and of each of its sessions
+func (U *host) SetBandwidth(host, connection int64) {
+	U.Bandwidth.SetRate(host)
+	U.SessionTable.Range(func(addr *net.UDPAddr, value interface{}) {
+		if s := value.(*Session); s.host == U {
+			s.bandwidth.SetRate(connection)
 		}
-		go U.Relay(conn, serviceconn, clientaddr)
-		U.ClientServerCache.Put(clientaddr, conn)
-	} else {
-		conn = testConn.(*net.UDPConn)
+	})
+}
+
+// allow returns if the datagram of n bytes fits into the bandwidth of the session, this host and the service
+func (U *host) allow(s *Session, n int, upstream bool) bool {
+	if upstream {
+		return handler.AllowAll(n, s.bandwidth.Upstream, U.Bandwidth.Upstream, U.TotalBandwidth.Upstream)
 	}
+	return handler.AllowAll(n, s.bandwidth.Downstream, U.Bandwidth.Downstream, U.TotalBandwidth.Downstream)
+}
 
-	if _, err = conn.WriteTo(buff, U.UDPAddr); err != nil {
+// Open opens a session of the client to this host and starts its relay.
+// The datagrams of the host are sent back to the client by the replier,
+// release is called once the relay is closed (or if the session couldn't be opened).
+func (U *host) Open(clientaddr *net.UDPAddr, replier *Replier, release func()) (*Session, error) {
+	endpoint, err := net.ResolveUDPAddr(U.Protocol, U.Resolver.Pick(nil))
+	if err != nil {
+		release()
+		log.Printf("Couldn't resolve %s (%s): %v", U.Name, U.Addr, err)
+		return nil, err
+	}
+	conn, err := net.ListenUDP(U.Protocol, nil)
+	if err != nil {
+		release()
+		log.Printf("Error dialing host: %v", err)
+		return nil, err
+	}
+	s := newSession(clientaddr, U, endpoint, conn, replier, handler.NewBandwidth(U.Config.Get().Bandwidth.ConnectionBytesPerSecond), release)
+	go U.Relay(s)
+	return s, nil
+}
+
+// usable returns if the sessions of this host may stay on it.
+// Draining hosts keep their sessions, removed, disabled or offline hosts don't.
+func (U *host) usable() bool {
+	return atomic.LoadInt32(&U.removed) == 0 && U.Status.IsOnline() && U.Status.GetState() != config.HostDisabled
+}
+
+// Forward forwards the datagram of the client of the session to this host
+func (U *host) Forward(s *Session, datagram []byte) error {
+	if !U.allow(s, len(datagram), true) {
+		return nil
+	}
+	if _, err := s.conn.WriteTo(datagram, s.endpoint); err != nil {
 		log.Printf("Unabel to forward packet to server (client->proxy-Xserver) %v", err)
-		U.ClientServerCache.Remove(clientaddr)
+		return err
 	}
-	return
+	s.upstream(len(datagram))
+	return nil
 }
 
-// Relay forwards packets from downstream to upstream/toaddr
-func (U *host) Relay(downstream net.PacketConn, upstream *net.UDPConn, toaddr *net.UDPAddr) {
-	buffer := make([]byte, MUDS)
+// Relay forwards packets from the upstream socket of the session to its client through its replier
+// until the session leaves the session table.
+func (U *host) Relay(s *Session) {
+	downstream := s.conn
 	U.Status.Lock()
 	U.Status.Connections++
 	U.Status.Unlock()
+	U.Relays.Add(downstream)
 
 	defer func() {
 		U.Status.Lock()
 		U.Status.Connections--
 		U.Status.Unlock()
+		U.Relays.Done(downstream)
 		downstream.Close()
+		if release := s.takeRelease(); release != nil {
+			release()
+		}
 	}()
 
-	if U.LogCon {
-		log.Printf("Started relaying %s->%s", U.UDPAddr.String(), toaddr.String())
+	if U.Config.Get().LogConfig.LogConnections {
+		log.Printf("Started relaying %s->%s", s.endpoint.String(), s.client.String())
 	}
 
+	// the relay waits for datagrams with its own buffer, pooled buffers are only taken to send one
+	read := make([]byte, U.Buffers.Size())
 	for {
-		downstream.SetReadDeadline(time.Now().Add(time.Millisecond * U.Timeout))
-		lenb, _, err := downstream.ReadFrom(buffer)
+		lenb, _, truncated, err := readDatagram(downstream, read)
 		if err != nil {
-			if U.LogDis {
-				log.Printf("Disconnected (server-Xproxy->client): %v", err)
+			reason, closed := s.closedReason()
+			if !closed {
+				U.SessionTable.CompareAndRemove(s.client, s, Removed)
+				if U.Config.Get().LogConfig.LogDisconnect {
+					log.Printf("Disconnected (server-Xproxy->client): %v", err)
+				}
+			} else if U.Config.Get().LogConfig.LogDisconnect {
+				log.Printf("Disconnected %s->%s (%s)", s.endpoint.String(), s.client.String(), reason)
 			}
 			return
 		}
-		upstream.WriteToUDP(buffer[:lenb], toaddr)
-		if err != nil {
-			log.Printf("Unable to forward datagram (server->proxy-Xclient): %v", err)
+		U.SessionTable.Touch(s.client)
+		if truncated {
+			U.Truncated.Add(s.endpoint)
+			continue
+		}
+		if !U.allow(s, lenb, false) {
+			continue
 		}
+		s.downstream(lenb)
+		buffer := U.Buffers.Get()
+		copy(*buffer, read[:lenb])
+		s.replier.Send(buffer, lenb, s.client)
 	}
 }
 
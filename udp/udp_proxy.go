@@ -2,39 +2,74 @@ package udp
 
 import (
 	"errors"
+	"fmt"
 	"log"
-	"math"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/worldOneo/glass-proxy/access"
 	"github.com/worldOneo/glass-proxy/cmd"
 	"github.com/worldOneo/glass-proxy/config"
+	"github.com/worldOneo/glass-proxy/handler"
 	"github.com/worldOneo/glass-proxy/proxy"
+	"github.com/worldOneo/glass-proxy/upgrade"
 )
 
-// MUDS defines the Maximum UDP Datagram Size
-const MUDS = 1200
+// workerQueueSize is the amount of datagrams waiting for each worker
+const workerQueueSize = 256
 
-var ebuff = make([]byte, MUDS)
+// packet is a datagram of a client waiting for a worker
+type packet struct {
+	buffer  *[]byte
+	n       int
+	addr    *net.UDPAddr
+	replier *Replier
+}
 
 // Service with everything we need
 type Service struct {
+	failoverMoved  uint64 // atomic counters first to be 64 bit aligned
+	failoverClosed uint64
 	sync.RWMutex
-	Cache          *Cache
+	SessionTable   *Cache
 	Hosts          []Host
 	HostsLock      *sync.RWMutex
-	Config         *config.Config
+	Config         *proxy.ConfigStore
 	CommandHandler *cmd.CommandHandler
+	Connections    *proxy.ConnTracker
+	Access         *access.Control
+	Limiter        *access.Limiter
+	Bans           *access.Bans
+	Bandwidth      *handler.Bandwidth
+	Repliers       []*Replier
+	Buffers        *BufferPool
+	Truncated      *TruncationCounter
+	serviceConns   []*net.UDPConn
+	closing        chan struct{}
+	closeOnce      sync.Once
 }
 
 // NewService creates a new Proxy Service and starts the cleaner
 func NewService(cnf *config.Config) *Service {
 	proxy := &Service{
-		Cache:          NewCache(time.Duration(cnf.UDPTimeout) * time.Millisecond),
-		Config:         cnf,
+		Config:         proxy.NewConfigStore(cnf),
 		CommandHandler: cmd.NewCommandHandler(),
 		HostsLock:      &sync.RWMutex{},
+		Connections:    proxy.NewConnTracker(),
+		Access:         &access.Control{},
+		Limiter:        access.NewLimiter(access.Limits(cnf.Limits)),
+		Bans:           access.NewBans(access.BanPolicy(cnf.Bans)),
+		Bandwidth:      handler.NewBandwidth(cnf.Bandwidth.TotalBytesPerSecond),
+		closing:        make(chan struct{}),
+	}
+	proxy.SessionTable = NewCache(time.Duration(cnf.UDPTimeout)*time.Millisecond, cnf.UDPMaxSessions, closeSession)
+	proxy.Buffers = NewBufferPool(cnf.GetUDPMaxDatagramSize())
+	proxy.Truncated = &TruncationCounter{size: proxy.Buffers.Size()}
+	if err := proxy.Access.Update(cnf.Allow, cnf.Deny); err != nil {
+		log.Printf("Invalid access lists: %v", err)
 	}
 	proxy.LoadHosts()
 
@@ -46,119 +81,494 @@ func (p *Service) LoadHosts() {
 	p.HostsLock.Lock()
 	defer p.HostsLock.Unlock()
 	hosts := make([]Host, 0)
-	for _, host := range p.Config.Hosts {
-		newHost := NewHost(host.Name, host.Addr, p.Config.Protocol,
-			p.Config.UDPTimeout, p.Config.LogConfig.LogConnections, p.Config.LogConfig.LogDisconnect)
+	cnf := p.Config.Get()
+	for _, host := range cnf.Hosts {
+		newHost := NewHost(host, p)
 		hosts = append(hosts, newHost)
 	}
 	p.Hosts = hosts
 }
 
-// Handle starts a conection (or redirects a datagram) to the client address
-func (p *Service) Handle(clientaddr *net.UDPAddr, datagram []byte, serviceconn *net.UDPConn) error {
-	host := p.Cache.Get(clientaddr)
+// Handle forwards the datagram of the client through its session and opens one for new clients.
+// Sessions of hosts which can't be used anymore fail over first.
+// The datagrams of the host are sent back to the client by the replier.
+func (p *Service) Handle(clientaddr *net.UDPAddr, datagram []byte, replier *Replier) error {
+	s := p.session(clientaddr)
+	if s != nil && !s.host.usable() {
+		s = p.failover(s)
+	}
+	if s == nil {
+		var err error
+		if s, err = p.open(clientaddr, replier); err != nil {
+			return err
+		}
+	}
+	err := s.host.Forward(s, datagram)
+	if err != nil {
+		p.SessionTable.CompareAndRemove(clientaddr, s, Removed)
+	}
+	return err
+}
+
+// session returns the session of the client or nil if it has none
+func (p *Service) session(clientaddr *net.UDPAddr) *Session {
+	if cached := p.SessionTable.Get(clientaddr); cached != nil {
+		return cached.(*Session)
+	}
+	return nil
+}
+
+// open opens a session of the client to the healthy host with the least sessions
+func (p *Service) open(clientaddr *net.UDPAddr, replier *Replier) (*Session, error) {
+	host := p.GetHost()
 	if host == nil {
+		return nil, errors.New("no healthy host available")
+	}
+	release, err := p.Limiter.Acquire(clientaddr)
+	if err != nil {
+		if p.Config.Get().LogConfig.LogConnections {
+			log.Printf("%s Rejected: %v", clientaddr, err)
+		}
+		return nil, err
+	}
+	s, err := host.Open(clientaddr, replier, release)
+	if err != nil {
+		return nil, err
+	}
+	p.SessionTable.Put(clientaddr, s)
+	return s, nil
+}
+
+// failover moves the session of a host which can't be used anymore to a healthy host
+// or closes it, depending on the UDPFailover policy.
+// It returns the session the client uses now or nil if it has none.
+func (p *Service) failover(s *Session) *Session {
+	var host Host
+	if p.Config.Get().GetUDPFailover() == config.FailoverReassign {
 		host = p.GetHost()
-		if host == nil {
-			return errors.New("no healthy host available")
+	}
+	if host == nil {
+		if p.SessionTable.CompareAndRemove(s.client, s, FailedOver) {
+			atomic.AddUint64(&p.failoverClosed, 1)
 		}
-		p.Cache.Put(clientaddr, host)
+		return p.session(s.client)
 	}
-	newDG := make([]byte, len(datagram))
-	copy(newDG, datagram)
-	go host.(Host).Connect(newDG, clientaddr, serviceconn)
-	return nil
+
+	release := s.takeRelease()
+	if release == nil {
+		var err error
+		if release, err = p.Limiter.Acquire(s.client); err != nil {
+			p.SessionTable.CompareAndRemove(s.client, s, FailedOver)
+			atomic.AddUint64(&p.failoverClosed, 1)
+			return p.session(s.client)
+		}
+	}
+	next, err := host.Open(s.client, s.replier, release)
+	if err != nil {
+		p.SessionTable.CompareAndRemove(s.client, s, FailedOver)
+		atomic.AddUint64(&p.failoverClosed, 1)
+		return p.session(s.client)
+	}
+	next.inherit(s)
+	if !p.SessionTable.Replace(s.client, s, next, FailedOver) {
+		next.close(Removed)
+		return p.session(s.client)
+	}
+	atomic.AddUint64(&p.failoverMoved, 1)
+	return next
+}
+
+// failoverHost fails over every session of the host, why is logged
+func (p *Service) failoverHost(h Host, why string) {
+	sessions := make([]*Session, 0)
+	p.SessionTable.Range(func(addr *net.UDPAddr, value interface{}) {
+		if s := value.(*Session); s.host == h {
+			sessions = append(sessions, s)
+		}
+	})
+	if len(sessions) == 0 {
+		return
+	}
+	moved, closed := 0, 0
+	for _, s := range sessions {
+		if next := p.failover(s); next != nil && next.host != h {
+			moved++
+		} else {
+			closed++
+		}
+	}
+	log.Printf("%s %s: moved %d sessions to other servers, closed %d", h.GetName(), why, moved, closed)
 }
 
-// HealthCheck (not implemented)
+// Failovers returns the amount of sessions moved to another host and closed because their host couldn't be used anymore
+func (p *Service) Failovers() (moved, closed uint64) {
+	return atomic.LoadUint64(&p.failoverMoved), atomic.LoadUint64(&p.failoverClosed)
+}
+
+// closeSession closes a session leaving the session table
+func closeSession(addr *net.UDPAddr, value interface{}, reason EvictReason) {
+	value.(*Session).close(reason)
+}
+
+// Sessions returns a snapshot of the active sessions
+func (p *Service) Sessions() []proxy.SessionInfo {
+	sessions := make([]proxy.SessionInfo, 0, p.SessionTable.Len())
+	p.SessionTable.Range(func(addr *net.UDPAddr, value interface{}) {
+		sessions = append(sessions, value.(*Session).Info())
+	})
+	return sessions
+}
+
+// HealthCheck checks the health of every host at once and fails over the sessions of hosts which went offline
 func (p *Service) HealthCheck() {
 	for {
-		p.HostsLock.RLock()
-		for _, h := range p.Hosts {
-			h.HealthCheck()
+		hosts := p.ListHosts()
+		offline := make([]bool, len(hosts))
+		wg := sync.WaitGroup{}
+		for i, h := range hosts {
+			wg.Add(1)
+			go func(i int, h Host) {
+				defer wg.Done()
+				online := h.GetStatus().IsOnline()
+				now, _ := h.HealthCheck()
+				offline[i] = online && !now
+			}(i, h.(Host))
+		}
+		wg.Wait()
+		for i, h := range hosts {
+			if offline[i] {
+				p.failoverHost(h.(Host), "offline")
+			}
+		}
+		select {
+		case <-p.closing:
+			return
+		case <-time.After(time.Duration(p.Config.Get().HealthCheckTime * float64(time.Second))):
 		}
-		p.HostsLock.RUnlock()
-		time.Sleep(time.Second * time.Duration(p.Config.HealthCheckTime))
 	}
 }
 
-// Run starts the UDP proxy
+// Run starts the UDP proxy and relays datagrams until the service is shut down
 func (p *Service) Run() error {
-	laddr, err := net.ResolveUDPAddr("udp", p.Config.Addr)
+	cnf := p.Config.Get()
+	laddr, err := net.ResolveUDPAddr("udp", cnf.Addr)
 	if err != nil {
-		log.Fatalf("Unabele to resolve \"%s\"", laddr)
-		return err
+		return fmt.Errorf("unable to resolve \"%s\": %v", cnf.Addr, err)
 	}
 
-	//go p.HealthCheck()
+	go p.HealthCheck()
+	go proxy.ResolveLoop(p.Config, p.ListHosts, p.closing)
 
-	serviceconn, err := net.ListenUDP(p.Config.Protocol, laddr)
+	packetconns, err := upgrade.ListenPacket(cnf.Protocol, laddr.String(), cnf.GetListeners())
 	if err != nil {
-		log.Fatalf("Unabele to listen on \"%s\"", laddr)
-		return err
+		return fmt.Errorf("unable to listen on \"%s\": %v", laddr, err)
+	}
+	serviceconns := make([]*net.UDPConn, 0, len(packetconns))
+	for _, packetconn := range packetconns {
+		serviceconn, ok := packetconn.(*net.UDPConn)
+		if !ok {
+			for _, packetconn := range packetconns {
+				packetconn.Close()
+			}
+			return fmt.Errorf("\"%s\" isn't a UDP address", laddr)
+		}
+		serviceconns = append(serviceconns, serviceconn)
+	}
+
+	batchSize := cnf.GetUDPBatchSize()
+	repliers := make([]*Replier, len(serviceconns))
+	for i := range repliers {
+		repliers[i] = NewReplier(workerQueueSize, p.Buffers)
+	}
+	p.Lock()
+	select {
+	case <-p.closing:
+		p.Unlock()
+		for _, serviceconn := range serviceconns {
+			serviceconn.Close()
+		}
+		return nil
+	default:
 	}
-	log.Print("Started")
+	p.serviceConns = serviceconns
+	p.Repliers = repliers
+	p.Unlock()
+	log.Printf("Started (%d listeners)", len(serviceconns))
+	upgrade.Ready()
 
-	datagram := make([]byte, MUDS)
+	workers := p.startWorkers(cnf.GetUDPWorkers())
+	var wg sync.WaitGroup
+	for i, serviceconn := range serviceconns {
+		conn := newBatchConn(serviceconn, batchSize)
+		go repliers[i].Run(conn, batchSize)
+		wg.Add(1)
+		go func(conn batchConn, replier *Replier) {
+			defer wg.Done()
+			p.read(conn, replier, workers, batchSize)
+		}(conn, repliers[i])
+	}
+	wg.Wait()
+	return nil
+}
+
+// read reads the datagrams of conn and passes them to the workers until the service is shut down.
+// The replier sends the responses back through the same socket.
+func (p *Service) read(conn batchConn, replier *Replier, workers []chan packet, batchSize int) {
+	buffers := make([]*[]byte, batchSize)
+	msgs := make([]message, batchSize)
+	for i := range msgs {
+		buffers[i] = p.Buffers.Get()
+		msgs[i].Buffer = *buffers[i]
+	}
+	defer func() {
+		for _, buffer := range buffers {
+			p.Buffers.Put(buffer)
+		}
+	}()
 	for {
-		ldat, clientaddr, err := serviceconn.ReadFromUDP(datagram)
+		n, err := conn.ReadBatch(msgs)
 		if err != nil {
+			select {
+			case <-p.closing:
+				return
+			default:
+			}
 			log.Printf("Unable to read datagram (client-Xproxy->server) %v", err)
 			continue
 		}
-		p.Handle(clientaddr, datagram[:ldat], serviceconn)
-		copy(datagram, ebuff)
+		for i := 0; i < n; i++ {
+			clientaddr := msgs[i].Addr
+			if msgs[i].Truncated {
+				p.Truncated.Add(clientaddr)
+				continue
+			}
+			if p.Bans.Banned(clientaddr) || p.Bans.Packet(clientaddr) {
+				continue
+			}
+			if !p.Access.Allowed(clientaddr) {
+				continue
+			}
+			select {
+			case workers[workerIndex(clientaddr, len(workers))] <- packet{buffer: buffers[i], n: msgs[i].N, addr: clientaddr, replier: replier}:
+			case <-p.closing:
+				return
+			}
+			buffers[i] = p.Buffers.Get()
+			msgs[i].Buffer = *buffers[i]
+		}
+	}
+}
+
+// startWorkers starts the workers which relay the datagrams of the clients until the service is shut down
+func (p *Service) startWorkers(count int) []chan packet {
+	workers := make([]chan packet, count)
+	for i := range workers {
+		queue := make(chan packet, workerQueueSize)
+		workers[i] = queue
+		go func() {
+			for {
+				select {
+				case next := <-queue:
+					p.Handle(next.addr, (*next.buffer)[:next.n], next.replier)
+					p.Buffers.Put(next.buffer)
+				case <-p.closing:
+					return
+				}
+			}
+		}()
+	}
+	return workers
+}
+
+// workerIndex returns the worker of the client so its datagrams stay in order
+func workerIndex(addr *net.UDPAddr, workers int) int {
+	hash := uint32(2166136261)
+	for _, b := range addr.IP {
+		hash = (hash ^ uint32(b)) * 16777619
 	}
+	hash = (hash ^ uint32(addr.Port)) * 16777619
+	return int(hash % uint32(workers))
 }
 
-// GetHost gets a random running host or nil if no host is available
+// ListenerFiles returns duplicates of the listening sockets to pass them to another process
+func (p *Service) ListenerFiles() ([]*os.File, error) {
+	p.Lock()
+	defer p.Unlock()
+	if len(p.serviceConns) == 0 {
+		return nil, errors.New("the service isn't listening")
+	}
+	files := make([]*os.File, 0, len(p.serviceConns))
+	for _, serviceconn := range p.serviceConns {
+		file, err := serviceconn.File()
+		if err != nil {
+			for _, file := range files {
+				file.Close()
+			}
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// Shutdown stops reading new datagrams and waits up to grace
+// for the active relays to time out before closing them.
+// The sockets stay open until then so the relays can still respond to their clients.
+func (p *Service) Shutdown(grace time.Duration) {
+	p.closeOnce.Do(func() {
+		p.Lock()
+		close(p.closing)
+		for _, serviceconn := range p.serviceConns {
+			serviceconn.SetReadDeadline(time.Now())
+		}
+		p.Unlock()
+	})
+	log.Printf("Waiting for %d relays to close...", p.Connections.Count())
+	p.Connections.Shutdown(grace)
+	p.Lock()
+	for _, serviceconn := range p.serviceConns {
+		serviceconn.Close()
+	}
+	for _, replier := range p.Repliers {
+		replier.Stop()
+	}
+	p.Unlock()
+}
+
+// GetHost gets the available host with the lowest priority and the least connections per weight
+// or nil if no host is available
 func (p *Service) GetHost() Host {
 	p.HostsLock.RLock()
 	defer p.HostsLock.RUnlock()
-
-	index := -1
-	min := math.MaxInt32
-	c := 0
+	hosts := make([]proxy.Host, len(p.Hosts))
 	for i, h := range p.Hosts {
-		c = h.GetStatus().GetConnectionCount()
-		if c < min {
-			min = c
-			index = i
+		hosts[i] = h
+	}
+	if selected := proxy.SelectHost(hosts); selected != nil {
+		return selected.(Host)
+	}
+	return nil
+}
+
+// SetHostState sets the administrative state of the host and updates the config.
+// The sessions of a disabled host fail over.
+func (p *Service) SetHostState(name, state string) error {
+	p.HostsLock.Lock()
+	err := p.Config.Update(func(cnf *config.Config) error {
+		return proxy.SetHostState(cnf.Hosts, name, state)
+	})
+	if err != nil {
+		p.HostsLock.Unlock()
+		return err
+	}
+	var changed Host
+	for _, h := range p.Hosts {
+		if h.GetName() == name {
+			h.SetState(state)
+			changed = h
 		}
 	}
-	if index == -1 {
-		return nil
+	p.HostsLock.Unlock()
+	if changed != nil && state == config.HostDisabled {
+		p.failoverHost(changed, "disabled")
 	}
-	return p.Hosts[index]
+	return nil
 }
 
-// AddHost adds a host to this proxy
+// DrainHost stops new clients from being assigned to the host and removes it once its relays are closed.
+// Remaining relays are closed after the timeout if it is greater than 0.
+func (p *Service) DrainHost(name string, timeout time.Duration) error {
+	return proxy.DrainHost(p, name, timeout)
+}
+
+// AddHost adds a host to this proxy and its config.
+// The already existing hosts and their relays stay untouched.
 func (p *Service) AddHost(hostconfig config.HostConfig) {
 	p.HostsLock.Lock()
 	defer p.HostsLock.Unlock()
-	host := NewHost(hostconfig.Name, hostconfig.Addr, p.Config.Protocol,
-		p.Config.UDPTimeout, p.Config.LogConfig.LogConnections, p.Config.LogConfig.LogDisconnect)
+	err := p.Config.Update(func(cnf *config.Config) error {
+		if proxy.HasHost(cnf.Hosts, hostconfig.Name) {
+			return errors.New("host " + hostconfig.Name + " already exists")
+		}
+		cnf.Hosts = append(cnf.Hosts, hostconfig)
+		return nil
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	host := NewHost(hostconfig, p)
 	p.Hosts = append(p.Hosts, host)
 }
 
-// RemHost removes a host from this proxy by host
+// RemHost removes a host from this proxy by name.
+// Its sessions fail over.
 func (p *Service) RemHost(name string) {
 	p.HostsLock.Lock()
-	hosts := make([]config.HostConfig, 0)
-	for _, host := range p.Config.Hosts {
-		if host.Name != name {
-			hosts = append(hosts, host)
+	p.Config.Update(func(cnf *config.Config) error {
+		cnf.Hosts = proxy.RemoveHost(cnf.Hosts, name)
+		return nil
+	})
+	hosts := make([]Host, 0, len(p.Hosts))
+	removed := make([]*host, 0)
+	for _, h := range p.Hosts {
+		if h.GetName() != name {
+			hosts = append(hosts, h)
+		} else if h, ok := h.(*host); ok {
+			atomic.StoreInt32(&h.removed, 1)
+			removed = append(removed, h)
 		}
 	}
-	p.Config.Hosts = hosts
+	p.Hosts = hosts
 	p.HostsLock.Unlock()
-	p.LoadHosts()
+	for _, h := range removed {
+		p.failoverHost(h, "removed")
+	}
 }
 
-// GetConfig returns the config.
-// changes to the config returned apply to the service.
+// GetConfig returns a copy of the config.
+// changes to the config returned don't apply to the service, use UpdateConfig instead.
 func (p *Service) GetConfig() *config.Config {
-	return p.Config
+	return p.Config.Get().Clone()
+}
+
+// AccessControl returns the allow and deny lists of the clients
+func (p *Service) AccessControl() *access.Control {
+	return p.Access
+}
+
+// TruncatedDatagrams returns the amount of datagrams dropped because they were larger than UDPMaxDatagramSize
+func (p *Service) TruncatedDatagrams() uint64 {
+	return p.Truncated.Count()
+}
+
+// ConnectionLimiter returns the limiter of the client connections
+func (p *Service) ConnectionLimiter() *access.Limiter {
+	return p.Limiter
+}
+
+// BanList returns the banned clients
+func (p *Service) BanList() *access.Bans {
+	return p.Bans
+}
+
+// SetBandwidth changes the bandwidth limits of the service, its hosts and their sessions
+func (p *Service) SetBandwidth(bandwidth config.BandwidthConfig) {
+	p.Config.Update(func(cnf *config.Config) error {
+		cnf.Bandwidth = bandwidth
+		return nil
+	})
+	p.Bandwidth.SetRate(bandwidth.TotalBytesPerSecond)
+	p.HostsLock.RLock()
+	defer p.HostsLock.RUnlock()
+	for _, h := range p.Hosts {
+		h.SetBandwidth(bandwidth.HostBytesPerSecond, bandwidth.ConnectionBytesPerSecond)
+	}
+}
+
+// UpdateConfig applies f to a copy of the config which replaces the config if f doesn't fail
+func (p *Service) UpdateConfig(f func(*config.Config) error) error {
+	return p.Config.Update(f)
 }
 
 // ListHosts returns all the active hosts of this proxy
@@ -0,0 +1,8 @@
+//go:build darwin || freebsd || openbsd || netbsd || dragonfly
+// +build darwin freebsd openbsd netbsd dragonfly
+
+package upgrade
+
+import "syscall"
+
+const soReusePort = syscall.SO_REUSEPORT
@@ -0,0 +1,7 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+// +build linux,!mips,!mipsle,!mips64,!mips64le
+
+package upgrade
+
+// soReusePort is SO_REUSEPORT, it is missing in the syscall package for most architectures
+const soReusePort = 0xf
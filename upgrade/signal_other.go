@@ -0,0 +1,12 @@
+//go:build windows || js || plan9
+// +build windows js plan9
+
+package upgrade
+
+import "os"
+
+// Signals returns the signals which trigger an upgrade.
+// Upgrades aren't supported on this system.
+func Signals() []os.Signal {
+	return nil
+}
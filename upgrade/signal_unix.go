@@ -0,0 +1,14 @@
+//go:build !windows && !js && !plan9
+// +build !windows,!js,!plan9
+
+package upgrade
+
+import (
+	"os"
+	"syscall"
+)
+
+// Signals returns the signals which trigger an upgrade
+func Signals() []os.Signal {
+	return []os.Signal{syscall.SIGUSR2}
+}
@@ -0,0 +1,239 @@
+package upgrade
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ReadyTimeout is the time the new process has to signal that it is ready
+const ReadyTimeout = 30 * time.Second
+
+// envUpgrade marks a process which was started by an upgrade, its value is the amount of inherited listeners
+const envUpgrade = "GLASS_UPGRADE"
+
+// The inherited file descriptors of a process started by an upgrade.
+// The listeners after the first one follow the ready pipe.
+const (
+	listenerFD = 3
+	readyFD    = 4
+)
+
+var (
+	child         = os.Getenv(envUpgrade) != ""
+	inheritedOnce sync.Once
+	readyOnce     sync.Once
+
+	// newFile opens an inherited file descriptor, tests replace it
+	newFile = os.NewFile
+)
+
+// IsChild returns if this process was started by an upgrade
+func IsChild() bool {
+	return child
+}
+
+// IsSignal returns if the signal triggers an upgrade
+func IsSignal(sig os.Signal) bool {
+	for _, s := range Signals() {
+		if s == sig {
+			return true
+		}
+	}
+	return false
+}
+
+// inherited returns the listener files inherited from the parent process or nil if there are none.
+// The listeners can only be inherited once.
+func inherited() (files []*os.File) {
+	if !child {
+		return nil
+	}
+	inheritedOnce.Do(func() {
+		count, err := strconv.Atoi(os.Getenv(envUpgrade))
+		if err != nil || count < 1 {
+			count = 1
+		}
+		os.Unsetenv(envUpgrade)
+		files = append(files, newFile(listenerFD, "listener"))
+		for i := 1; i < count; i++ {
+			files = append(files, newFile(uintptr(readyFD+i), "listener"))
+		}
+	})
+	return files
+}
+
+// listenConfig returns the config to open count sockets on the same address
+func listenConfig(count int) *net.ListenConfig {
+	if count <= 1 {
+		return &net.ListenConfig{}
+	}
+	return &net.ListenConfig{Control: reusePort}
+}
+
+// Listen opens count listeners on the address (with SO_REUSEPORT if there are several)
+// or takes over the listeners inherited from the parent process
+func Listen(network, addr string, count int) ([]net.Listener, error) {
+	if count < 1 {
+		count = 1
+	}
+	listeners := make([]net.Listener, 0, count)
+	files := inherited()
+	if files == nil {
+		lc := listenConfig(count)
+		for len(listeners) < count {
+			ln, err := lc.Listen(context.Background(), network, addr)
+			if err != nil {
+				closeListeners(listeners)
+				return nil, err
+			}
+			listeners = append(listeners, ln)
+		}
+		return listeners, nil
+	}
+	for _, file := range files {
+		ln, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+	if len(listeners) != count {
+		log.Printf("Inherited %d listeners on %s but %d are configured", len(listeners), addr, count)
+	}
+	for len(listeners) > count {
+		listeners[len(listeners)-1].Close()
+		listeners = listeners[:len(listeners)-1]
+	}
+	lc := listenConfig(count)
+	for len(listeners) < count {
+		ln, err := lc.Listen(context.Background(), network, addr)
+		if err != nil {
+			log.Printf("Couldn't open more listeners on %s, keeping %d \"%v\"", addr, len(listeners), err)
+			break
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// ListenPacket opens count packet conns on the address (with SO_REUSEPORT if there are several)
+// or takes over the packet conns inherited from the parent process
+func ListenPacket(network, addr string, count int) ([]net.PacketConn, error) {
+	if count < 1 {
+		count = 1
+	}
+	conns := make([]net.PacketConn, 0, count)
+	files := inherited()
+	if files == nil {
+		lc := listenConfig(count)
+		for len(conns) < count {
+			conn, err := lc.ListenPacket(context.Background(), network, addr)
+			if err != nil {
+				closePacketConns(conns)
+				return nil, err
+			}
+			conns = append(conns, conn)
+		}
+		return conns, nil
+	}
+	for _, file := range files {
+		conn, err := net.FilePacketConn(file)
+		file.Close()
+		if err != nil {
+			closePacketConns(conns)
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+	if len(conns) != count {
+		log.Printf("Inherited %d packet conns on %s but %d are configured", len(conns), addr, count)
+	}
+	for len(conns) > count {
+		conns[len(conns)-1].Close()
+		conns = conns[:len(conns)-1]
+	}
+	lc := listenConfig(count)
+	for len(conns) < count {
+		conn, err := lc.ListenPacket(context.Background(), network, addr)
+		if err != nil {
+			log.Printf("Couldn't open more packet conns on %s, keeping %d \"%v\"", addr, len(conns), err)
+			break
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+// closeListeners closes the listeners opened before an error
+func closeListeners(listeners []net.Listener) {
+	for _, ln := range listeners {
+		ln.Close()
+	}
+}
+
+// closePacketConns closes the packet conns opened before an error
+func closePacketConns(conns []net.PacketConn) {
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// Ready signals the parent process that this process accepts connections
+// and the parent can start to shut down. It does nothing if there is no parent.
+func Ready() {
+	if !child {
+		return
+	}
+	readyOnce.Do(func() {
+		ready := os.NewFile(readyFD, "ready")
+		ready.Write([]byte{1})
+		ready.Close()
+	})
+}
+
+// Start starts the current executable with the same arguments and passes the listeners to it.
+// It returns once the new process is ready to accept connections.
+func Start(listeners []*os.File) (*os.Process, error) {
+	if len(listeners) == 0 {
+		return nil, errors.New("no listener to pass")
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyR.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), envUpgrade+"="+strconv.Itoa(len(listeners)))
+	cmd.ExtraFiles = append([]*os.File{listeners[0], readyW}, listeners[1:]...)
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	readyR.SetReadDeadline(time.Now().Add(ReadyTimeout))
+	buf := make([]byte, 1)
+	if _, err := readyR.Read(buf); err != nil {
+		cmd.Process.Kill()
+		return nil, errors.New("new process didn't become ready: " + err.Error())
+	}
+	go cmd.Wait()
+	return cmd.Process, nil
+}
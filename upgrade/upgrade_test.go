@@ -0,0 +1,172 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly
+// +build linux darwin freebsd openbsd netbsd dragonfly
+
+package upgrade
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// inherit makes the next call to inherited return copies of the files
+// as if they were passed by a parent process
+func inherit(t *testing.T, files []*os.File) {
+	fds := map[uintptr]*os.File{listenerFD: files[0]}
+	for i, file := range files[1:] {
+		fds[uintptr(readyFD+i+1)] = file
+	}
+	child = true
+	inheritedOnce = sync.Once{}
+	newFile = func(fd uintptr, name string) *os.File {
+		return fds[fd]
+	}
+	os.Setenv(envUpgrade, strconv.Itoa(len(files)))
+	t.Cleanup(func() {
+		child = false
+		newFile = os.NewFile
+		os.Unsetenv(envUpgrade)
+	})
+}
+
+func listenerFiles(t *testing.T, listeners []net.Listener) []*os.File {
+	files := make([]*os.File, 0, len(listeners))
+	for _, ln := range listeners {
+		file, err := ln.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+	return files
+}
+
+// accepts checks that connections to the listeners' address are accepted by them
+func accepts(t *testing.T, listeners []net.Listener) {
+	t.Helper()
+	accepted := make(chan struct{}, 10)
+	for _, ln := range listeners {
+		go func(ln net.Listener) {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+				accepted <- struct{}{}
+			}
+		}(ln)
+	}
+	for i := 0; i < 10; i++ {
+		conn, err := net.Dial("tcp", listeners[0].Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		select {
+		case <-accepted:
+		case <-time.After(time.Second):
+			t.Fatal("Connection wasn't accepted")
+		}
+	}
+}
+
+func TestListenReusePort(t *testing.T) {
+	listeners, err := Listen("tcp", "127.0.0.1:0", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listeners[0].Addr().String()
+	closeListeners(listeners)
+
+	listeners, err = Listen("tcp", addr, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeListeners(listeners)
+	if len(listeners) != 3 {
+		t.Fatalf("Listen opened %d listeners, expected 3", len(listeners))
+	}
+	for _, ln := range listeners {
+		if ln.Addr().String() != addr {
+			t.Fatalf("Listener on %s, expected %s", ln.Addr(), addr)
+		}
+	}
+}
+
+func TestListenInherited(t *testing.T) {
+	listeners, err := Listen("tcp", "127.0.0.1:0", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listeners[0].Addr().String()
+	closeListeners(listeners)
+	parent, err := Listen("tcp", addr, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inherit(t, listenerFiles(t, parent))
+	closeListeners(parent)
+
+	listeners, err = Listen("tcp", addr, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeListeners(listeners)
+	if len(listeners) != 3 {
+		t.Fatalf("Inherited %d listeners, expected 3", len(listeners))
+	}
+	for _, ln := range listeners {
+		if ln.Addr().String() != addr {
+			t.Fatalf("Inherited listener on %s, expected %s", ln.Addr(), addr)
+		}
+	}
+	accepts(t, listeners)
+	if inherited() != nil {
+		t.Fatal("Listeners were inherited twice")
+	}
+}
+
+func TestListenInheritedCount(t *testing.T) {
+	listeners, err := Listen("tcp", "127.0.0.1:0", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listeners[0].Addr().String()
+	closeListeners(listeners)
+
+	parent, err := Listen("tcp", addr, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inherit(t, listenerFiles(t, parent))
+	closeListeners(parent)
+	listeners, err = Listen("tcp", addr, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 2 {
+		t.Fatalf("Kept %d inherited listeners, expected 2", len(listeners))
+	}
+	accepts(t, listeners)
+	closeListeners(listeners)
+
+	parent, err = Listen("tcp", addr, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inherit(t, listenerFiles(t, parent))
+	closeListeners(parent)
+	listeners, err = Listen("tcp", addr, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeListeners(listeners)
+	if len(listeners) != 4 {
+		t.Fatalf("Opened %d listeners after the inherited ones, expected 4", len(listeners))
+	}
+	accepts(t, listeners)
+}